@@ -0,0 +1,84 @@
+package highlander
+
+import (
+	"net/http"
+	"strings"
+
+	authenticationv1 "k8s.io/api/authentication/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+)
+
+const (
+	auditDecisionAnnotation  = "highlander.kralicky.dev/decision"
+	auditConflictsAnnotation = "highlander.kralicky.dev/conflicts"
+)
+
+// auditEvent mirrors the fields of an audit.k8s.io/v1 Event which are
+// relevant to an admission decision.
+type auditEvent struct {
+	metav1.TypeMeta          `json:",inline"`
+	Level                    string                    `json:"level"`
+	AuditID                  types.UID                 `json:"auditID"`
+	Stage                    string                    `json:"stage"`
+	Verb                     string                    `json:"verb"`
+	User                     authenticationv1.UserInfo `json:"user"`
+	ObjectRef                *auditObjectReference     `json:"objectRef,omitempty"`
+	ResponseStatus           *metav1.Status            `json:"responseStatus,omitempty"`
+	RequestReceivedTimestamp metav1.MicroTime          `json:"requestReceivedTimestamp"`
+	StageTimestamp           metav1.MicroTime          `json:"stageTimestamp"`
+	Annotations              map[string]string         `json:"annotations,omitempty"`
+}
+
+type auditObjectReference struct {
+	Resource    string `json:"resource,omitempty"`
+	Namespace   string `json:"namespace,omitempty"`
+	Name        string `json:"name,omitempty"`
+	APIGroup    string `json:"apiGroup,omitempty"`
+	APIVersion  string `json:"apiVersion,omitempty"`
+	Subresource string `json:"subresource,omitempty"`
+}
+
+func newAuditEvent(req admission.Request, record DecisionRecord) auditEvent {
+	status := &metav1.Status{
+		Status:  metav1.StatusSuccess,
+		Code:    http.StatusOK,
+		Message: record.Reason,
+	}
+	if record.Decision == DecisionDenied {
+		status.Status = metav1.StatusFailure
+		status.Code = http.StatusForbidden
+		status.Reason = metav1.StatusReasonForbidden
+	}
+	annotations := map[string]string{
+		auditDecisionAnnotation: record.Decision,
+	}
+	if len(record.Conflicts) > 0 {
+		annotations[auditConflictsAnnotation] = strings.Join(record.Conflicts, ",")
+	}
+	timestamp := metav1.NewMicroTime(record.Timestamp)
+	return auditEvent{
+		TypeMeta: metav1.TypeMeta{
+			APIVersion: "audit.k8s.io/v1",
+			Kind:       "Event",
+		},
+		Level:   "Metadata",
+		AuditID: req.UID,
+		Stage:   "ResponseComplete",
+		Verb:    strings.ToLower(string(req.Operation)),
+		User:    req.UserInfo,
+		ObjectRef: &auditObjectReference{
+			Resource:    req.Resource.Resource,
+			Namespace:   req.Namespace,
+			Name:        req.Name,
+			APIGroup:    req.Resource.Group,
+			APIVersion:  req.Resource.Version,
+			Subresource: req.SubResource,
+		},
+		ResponseStatus:           status,
+		RequestReceivedTimestamp: timestamp,
+		StageTimestamp:           timestamp,
+		Annotations:              annotations,
+	}
+}
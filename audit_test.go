@@ -0,0 +1,49 @@
+package highlander
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+func TestDecisionLogAuditFormat(t *testing.T) {
+	buf := &bytes.Buffer{}
+	w := newTestWebhook(t, []client.Object{configMap("default", "existing")},
+		WithDecisionLog(buf),
+		WithDecisionLogFormat(DecisionLogFormatAudit))
+
+	req := createRequest(t, configMap("default", "new"))
+	req.UID = "request-uid"
+	req.UserInfo.Username = "alice"
+	req.Resource = metav1.GroupVersionResource{Version: "v1", Resource: "configmaps"}
+	expectDenied(t, w.Handle(context.Background(), req))
+
+	event := auditEvent{}
+	if err := json.Unmarshal(buf.Bytes(), &event); err != nil {
+		t.Fatal(err)
+	}
+	if event.APIVersion != "audit.k8s.io/v1" || event.Kind != "Event" ||
+		event.Stage != "ResponseComplete" || event.Level != "Metadata" {
+		t.Errorf("unexpected event type %+v", event)
+	}
+	if event.AuditID != "request-uid" || event.Verb != "create" || event.User.Username != "alice" {
+		t.Errorf("unexpected request fields %+v", event)
+	}
+	if ref := event.ObjectRef; ref == nil || ref.Resource != "configmaps" || ref.APIVersion != "v1" ||
+		ref.Namespace != "default" || ref.Name != "new" {
+		t.Errorf("unexpected object reference %+v", event.ObjectRef)
+	}
+	if status := event.ResponseStatus; status == nil || status.Code != http.StatusForbidden ||
+		status.Reason != metav1.StatusReasonForbidden || status.Message != ErrThereCanBeOnlyOne.Error() {
+		t.Errorf("unexpected response status %+v", event.ResponseStatus)
+	}
+	if event.Annotations[auditDecisionAnnotation] != DecisionDenied ||
+		event.Annotations[auditConflictsAnnotation] != "existing" {
+		t.Errorf("unexpected annotations %v", event.Annotations)
+	}
+}
@@ -0,0 +1,63 @@
+package highlander
+
+import (
+	"context"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/apiutil"
+)
+
+// CheckBatch checks whether each of the given objects could be created, as
+// if they were all created in order. Each object is checked against the
+// existing instances in the cluster as well as the earlier objects in the
+// batch which would have been allowed, so that duplicates within the batch
+// are caught. The returned slice contains one result for each object, which
+// is nil if the object would be allowed. Objects of other kinds are ignored.
+// The check has no side effects, and the webhook must already be set up.
+func (w *Webhook) CheckBatch(ctx context.Context, objs []client.Object) []error {
+	errs := make([]error, len(objs))
+	var pending []unstructured.Unstructured
+	for i, o := range objs {
+		obj, err := w.toUnstructured(o)
+		if err != nil {
+			errs[i] = err
+			continue
+		}
+		if obj.GroupVersionKind().GroupKind() != w.gvk.GroupKind() {
+			continue
+		}
+		_, errs[i] = w.validateCreate(ctx, obj, validateOptions{
+			reader:  w.cli,
+			cached:  true,
+			dryRun:  true,
+			pending: pending,
+		})
+		if errs[i] == nil {
+			pending = append(pending, *obj)
+		}
+	}
+	return errs
+}
+
+func (w *Webhook) toUnstructured(obj client.Object) (*unstructured.Unstructured, error) {
+	if u, ok := obj.(*unstructured.Unstructured); ok {
+		return u, nil
+	}
+	scheme := w.cli.Scheme()
+	if w.scheme != nil {
+		scheme = w.scheme
+	}
+	gvk, err := apiutil.GVKForObject(obj, scheme)
+	if err != nil {
+		return nil, err
+	}
+	content, err := runtime.DefaultUnstructuredConverter.ToUnstructured(obj)
+	if err != nil {
+		return nil, err
+	}
+	u := &unstructured.Unstructured{Object: content}
+	u.SetGroupVersionKind(gvk)
+	return u, nil
+}
@@ -0,0 +1,52 @@
+package highlander
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	coordinationv1 "k8s.io/api/coordination/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+func TestCheckBatch(t *testing.T) {
+	w := newTestWebhook(t, []client.Object{configMap("default", "existing")},
+		WithLease("highlander"))
+
+	errs := w.CheckBatch(context.Background(), []client.Object{
+		configMap("default", "a"),
+		configMap("other", "a"),
+		toUnstructured(t, configMap("other", "b")),
+		&corev1.Secret{ObjectMeta: metav1.ObjectMeta{Namespace: "other", Name: "c"}},
+		configMap("third", "a"),
+	})
+	if len(errs) != 5 {
+		t.Fatalf("expected one result per object, got %d", len(errs))
+	}
+	// Conflicts with an existing instance
+	if !errors.Is(errs[0], ErrThereCanBeOnlyOne) {
+		t.Errorf("expected a conflict with the existing instance, got %v", errs[0])
+	}
+	if errs[1] != nil {
+		t.Errorf("expected the first object in its namespace to be allowed, got %v", errs[1])
+	}
+	// Conflicts with an earlier object in the batch
+	var conflict *ConflictError
+	if !errors.As(errs[2], &conflict) || len(conflict.Conflicts) != 1 || conflict.Conflicts[0] != "a" {
+		t.Errorf("expected a conflict with the earlier object, got %v", errs[2])
+	}
+	if errs[3] != nil || errs[4] != nil {
+		t.Errorf("expected other kinds and other namespaces to be allowed, got %v, %v", errs[3], errs[4])
+	}
+
+	// The check has no side effects
+	leases := &coordinationv1.LeaseList{}
+	if err := w.cli.List(context.Background(), leases); err != nil {
+		t.Fatal(err)
+	}
+	if len(leases.Items) != 0 {
+		t.Errorf("the check acquired %d lease(s)", len(leases.Items))
+	}
+}
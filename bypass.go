@@ -0,0 +1,93 @@
+package highlander
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+// BypassTokenAnnotation holds a token, created with BypassToken, which
+// permits a create that would otherwise be denied. See WithBypassSecret.
+const BypassTokenAnnotation = "highlander.kralicky.dev/bypass-token"
+
+var (
+	ErrBypassTokenInvalid = errors.New("bypass token is invalid")
+	ErrBypassTokenExpired = errors.New("bypass token has expired")
+)
+
+// WithBypassSecret allows a create which would be denied to be admitted if
+// it carries a valid, unexpired token in the BypassTokenAnnotation
+// annotation. Tokens are signed with the given secret using HMAC-SHA256 and
+// are bound to the kind, namespace and name of the object, so they cannot be
+// created without the secret or reused for other objects. Use BypassToken to
+// create a token. Creates with an invalid or expired token are denied.
+func WithBypassSecret(secret []byte) Option {
+	return func(w *Webhook) {
+		w.bypassSecret = secret
+	}
+}
+
+// BypassToken returns a token for the BypassTokenAnnotation annotation which
+// permits creating the object of the given kind with the given namespace and
+// name until the expiry time. The token can be used again if the object is
+// deleted and recreated before the token expires, but not for any other
+// object. Objects created with generateName cannot use a token, since their
+// name is not known in advance. The version of the gvk is not part of the
+// token.
+func BypassToken(
+	secret []byte,
+	gvk schema.GroupVersionKind,
+	namespace string,
+	name string,
+	expiry time.Time,
+) string {
+	expires := strconv.FormatInt(expiry.Unix(), 10)
+	return expires + "." + signBypassToken(secret, gvk.GroupKind(), namespace, name, expires)
+}
+
+func signBypassToken(
+	secret []byte,
+	gk schema.GroupKind,
+	namespace string,
+	name string,
+	expires string,
+) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(gk.String() + "\n" + namespace + "\n" + name + "\n" + expires))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// verifyBypassToken checks the token in the object's BypassTokenAnnotation
+// annotation. It returns false if the object has no token.
+func (w *Webhook) verifyBypassToken(obj *unstructured.Unstructured) (bool, error) {
+	token, ok := obj.GetAnnotations()[BypassTokenAnnotation]
+	if !ok {
+		return false, nil
+	}
+	parts := strings.SplitN(token, ".", 2)
+	if len(parts) != 2 {
+		return true, ErrBypassTokenInvalid
+	}
+	expected := signBypassToken(w.bypassSecret, w.gvk.GroupKind(),
+		obj.GetNamespace(), obj.GetName(), parts[0])
+	if !hmac.Equal([]byte(parts[1]), []byte(expected)) {
+		return true, ErrBypassTokenInvalid
+	}
+	expires, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return true, ErrBypassTokenInvalid
+	}
+	if time.Now().After(time.Unix(expires, 0)) {
+		return true, fmt.Errorf("%w at %s", ErrBypassTokenExpired,
+			time.Unix(expires, 0).UTC().Format(time.RFC3339))
+	}
+	return true, nil
+}
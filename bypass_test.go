@@ -0,0 +1,96 @@
+package highlander
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+func withBypassToken(obj *corev1.ConfigMap, token string) *corev1.ConfigMap {
+	obj.Annotations = map[string]string{BypassTokenAnnotation: token}
+	return obj
+}
+
+func TestBypassToken(t *testing.T) {
+	secret := []byte("secret")
+	existing := configMap("default", "existing")
+	w := newTestWebhook(t, []client.Object{existing}, WithBypassSecret(secret))
+	expiry := time.Now().Add(time.Hour)
+	valid := BypassToken(secret, configMapGVK, "default", "new", expiry)
+
+	resp := w.Handle(context.Background(), createRequest(t, withBypassToken(configMap("default", "new"), valid)))
+	expectAllowed(t, resp)
+	if len(resp.Warnings) != 1 || !strings.HasPrefix(resp.Warnings[0], "allowed by bypass token") {
+		t.Errorf("expected a bypass warning, got %v", resp.Warnings)
+	}
+	// The version is not part of the token
+	v2 := BypassToken(secret, configMapGVK.GroupKind().WithVersion("v2"), "default", "new", expiry)
+	expectAllowed(t, w.Handle(context.Background(), createRequest(t, withBypassToken(configMap("default", "new"), v2))))
+
+	cases := []struct {
+		name  string
+		token string
+		err   error
+	}{
+		{
+			name:  "expired",
+			token: BypassToken(secret, configMapGVK, "default", "new", time.Now().Add(-time.Hour)),
+			err:   ErrBypassTokenExpired,
+		},
+		{
+			name:  "wrong secret",
+			token: BypassToken([]byte("other"), configMapGVK, "default", "new", expiry),
+			err:   ErrBypassTokenInvalid,
+		},
+		{
+			name:  "other name",
+			token: BypassToken(secret, configMapGVK, "default", "other", expiry),
+			err:   ErrBypassTokenInvalid,
+		},
+		{
+			name:  "other namespace",
+			token: BypassToken(secret, configMapGVK, "other", "new", expiry),
+			err:   ErrBypassTokenInvalid,
+		},
+		{
+			name:  "other kind",
+			token: BypassToken(secret, schema.GroupVersionKind{Version: "v1", Kind: "Secret"}, "default", "new", expiry),
+			err:   ErrBypassTokenInvalid,
+		},
+		{
+			name:  "extended expiry",
+			token: strings.Replace(valid, ".", "0.", 1),
+			err:   ErrBypassTokenInvalid,
+		},
+		{
+			name:  "malformed",
+			token: "token",
+			err:   ErrBypassTokenInvalid,
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			resp := w.Handle(context.Background(), createRequest(t, withBypassToken(configMap("default", "new"), c.token)))
+			expectDenied(t, resp)
+			if !strings.Contains(string(resp.Result.Reason), c.err.Error()) {
+				t.Errorf("expected the reason to contain %q, got %q", c.err, resp.Result.Reason)
+			}
+		})
+	}
+
+	// Without a conflict, the token is not checked
+	expectAllowed(t, w.Handle(context.Background(),
+		createRequest(t, withBypassToken(configMap("other", "new"), "token"))))
+}
+
+func TestBypassTokenWithoutSecret(t *testing.T) {
+	secret := []byte("secret")
+	w := newTestWebhook(t, []client.Object{configMap("default", "existing")})
+	token := BypassToken(secret, configMapGVK, "default", "new", time.Now().Add(time.Hour))
+	expectDenied(t, w.Handle(context.Background(), createRequest(t, withBypassToken(configMap("default", "new"), token))))
+}
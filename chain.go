@@ -0,0 +1,34 @@
+package highlander
+
+import (
+	"context"
+
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+)
+
+var _ admission.Handler = (*Webhook)(nil)
+
+// Chain returns a handler which runs each of the given handlers in order.
+// The first response that does not allow the request, whether denied or
+// errored, is returned with its result unchanged, and the remaining handlers
+// are not run. Warnings from the handlers which ran are kept in the
+// response. Patches returned by the handlers are dropped, so Chain should
+// only be used with validating handlers.
+func Chain(handlers ...admission.Handler) admission.Handler {
+	return admission.HandlerFunc(
+		func(ctx context.Context, req admission.Request) admission.Response {
+			var warnings []string
+			for _, h := range handlers {
+				resp := h.Handle(ctx, req)
+				if !resp.Allowed {
+					resp.Warnings = append(warnings, resp.Warnings...)
+					resp.Patches = nil
+					resp.PatchType = nil
+					resp.Patch = nil
+					return resp
+				}
+				warnings = append(warnings, resp.Warnings...)
+			}
+			return admission.Allowed("").WithWarnings(warnings...)
+		})
+}
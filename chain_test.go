@@ -0,0 +1,137 @@
+package highlander
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	admissionv1 "k8s.io/api/admission/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/webhook"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+)
+
+func TestChain(t *testing.T) {
+	allow := admission.HandlerFunc(func(context.Context, admission.Request) admission.Response {
+		return admission.Allowed("").WithWarnings("first")
+	})
+	deny := admission.HandlerFunc(func(context.Context, admission.Request) admission.Response {
+		return admission.Denied("second")
+	})
+	ran := false
+	last := admission.HandlerFunc(func(context.Context, admission.Request) admission.Response {
+		ran = true
+		return admission.Allowed("").WithWarnings("third")
+	})
+
+	resp := Chain(allow, last).Handle(context.Background(), admission.Request{})
+	expectAllowed(t, resp)
+	if len(resp.Warnings) != 2 || resp.Warnings[0] != "first" || resp.Warnings[1] != "third" {
+		t.Errorf("expected the warnings of both handlers, got %v", resp.Warnings)
+	}
+
+	ran = false
+	resp = Chain(allow, deny, last).Handle(context.Background(), admission.Request{})
+	if resp.Allowed || resp.Result.Reason != "second" {
+		t.Errorf("expected the denial of the second handler, got %+v", resp.Result)
+	}
+	if ran {
+		t.Error("handlers after a denial must not run")
+	}
+	if len(resp.Warnings) != 1 || resp.Warnings[0] != "first" {
+		t.Errorf("expected the warnings of the first handler, got %v", resp.Warnings)
+	}
+
+	errored := admission.HandlerFunc(func(context.Context, admission.Request) admission.Response {
+		return admission.Errored(http.StatusInternalServerError, errors.New("unavailable")).
+			WithWarnings("errored")
+	})
+	resp = Chain(errored, last).Handle(context.Background(), admission.Request{})
+	expectErrored(t, resp, http.StatusInternalServerError)
+	if resp.Result.Message != "unavailable" {
+		t.Errorf("expected the error of the first handler, got %+v", resp.Result)
+	}
+	if ran {
+		t.Error("handlers after an error must not run")
+	}
+	resp = Chain(allow, errored, last).Handle(context.Background(), admission.Request{})
+	expectErrored(t, resp, http.StatusInternalServerError)
+	if ran {
+		t.Error("handlers after an error must not run")
+	}
+	if len(resp.Warnings) != 2 || resp.Warnings[0] != "first" || resp.Warnings[1] != "errored" {
+		t.Errorf("expected the warnings gathered so far, got %v", resp.Warnings)
+	}
+
+	// Patches are dropped
+	patching := admission.HandlerFunc(func(context.Context, admission.Request) admission.Response {
+		return admission.PatchResponseFromRaw([]byte(`{}`), []byte(`{"a":"b"}`))
+	})
+	resp = Chain(patching, allow).Handle(context.Background(), admission.Request{})
+	expectAllowed(t, resp)
+	if len(resp.Patches) != 0 || resp.PatchType != nil {
+		t.Errorf("expected patches to be dropped, got %v", resp.Patches)
+	}
+}
+
+func TestMiddleware(t *testing.T) {
+	denyAll := admission.HandlerFunc(func(context.Context, admission.Request) admission.Response {
+		return admission.Denied("denied by middleware")
+	})
+	server := &webhook.Server{}
+	w := NewFor(&corev1.ConfigMap{}, WithMiddleware(func(h admission.Handler) admission.Handler {
+		return Chain(h, denyAll)
+	}))
+	if err := w.SetupWithServer(server, testScheme, newTestClient()); err != nil {
+		t.Fatal(err)
+	}
+
+	resp := serveAdmission(t, server, generateValidatePath(configMapGVK),
+		createRequest(t, configMap("default", "new")))
+	if resp.Allowed || resp.Result == nil || resp.Result.Reason != "denied by middleware" {
+		t.Errorf("expected the request to be denied by the middleware, got %+v", resp.Result)
+	}
+}
+
+// serveAdmission sends the request to the webhook registered on the server
+// at the given path, and returns its response.
+func serveAdmission(
+	t *testing.T,
+	server *webhook.Server,
+	path string,
+	req admission.Request,
+) *admissionv1.AdmissionResponse {
+	t.Helper()
+	req.UID = types.UID("test")
+	body, err := json.Marshal(admissionv1.AdmissionReview{
+		TypeMeta: metav1.TypeMeta{
+			APIVersion: admissionv1.SchemeGroupVersion.String(),
+			Kind:       "AdmissionReview",
+		},
+		Request: &req.AdmissionRequest,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	httpReq := httptest.NewRequest(http.MethodPost, path, bytes.NewReader(body))
+	httpReq.Header.Set("Content-Type", "application/json")
+	rec := httptest.NewRecorder()
+	server.WebhookMux.ServeHTTP(rec, httpReq)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("unexpected status %d: %s", rec.Code, rec.Body.String())
+	}
+	review := admissionv1.AdmissionReview{}
+	if err := json.Unmarshal(rec.Body.Bytes(), &review); err != nil {
+		t.Fatal(err)
+	}
+	if review.Response == nil {
+		t.Fatal("review has no response")
+	}
+	return review.Response
+}
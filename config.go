@@ -0,0 +1,229 @@
+package highlander
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Config is a snapshot of a webhook's resolved configuration.
+type Config struct {
+	Group                     string               `json:"group"`
+	Version                   string               `json:"version"`
+	Kind                      string               `json:"kind"`
+	Path                      string               `json:"path"`
+	MutatePath                string               `json:"mutatePath,omitempty"`
+	Namespaced                bool                 `json:"namespaced"`
+	CustomScheme              bool                 `json:"customScheme"`
+	Scope                     string               `json:"scope"`
+	ScopeAnnotation           string               `json:"scopeAnnotation,omitempty"`
+	ScopeField                string               `json:"scopeField,omitempty"`
+	ScopeNamespaceField       string               `json:"scopeNamespaceField,omitempty"`
+	ClusterWide               bool                 `json:"clusterWide"`
+	ScopeByUser               bool                 `json:"scopeByUser"`
+	OwnerChainScope           string               `json:"ownerChainScope,omitempty"`
+	OwnerChainRequired        bool                 `json:"ownerChainRequired"`
+	Sharded                   bool                 `json:"sharded"`
+	Drained                   bool                 `json:"drained"`
+	PausedNamespaces          map[string]time.Time `json:"pausedNamespaces,omitempty"`
+	EnforcementMode           EnforcementMode      `json:"enforcementMode"`
+	EnforcementEnvVar         string               `json:"enforcementEnvVar,omitempty"`
+	DecodeFailurePolicy       DecodeFailurePolicy  `json:"decodeFailurePolicy"`
+	ExcludeSystemNamespaces   bool                 `json:"excludeSystemNamespaces"`
+	RequireNamespace          bool                 `json:"requireNamespace"`
+	FixedNamespace            string               `json:"fixedNamespace,omitempty"`
+	SkipTerminatingNamespaces bool                 `json:"skipTerminatingNamespaces"`
+	ImmutableIdentity         bool                 `json:"immutableIdentity"`
+	Impersonate               bool                 `json:"impersonate"`
+	AdmittedAt                bool                 `json:"admittedAtAnnotation"`
+	Verdict                   bool                 `json:"verdictAnnotation"`
+	Duplicate                 bool                 `json:"duplicateAnnotation"`
+	MaxConcurrent             int                  `json:"maxConcurrent"`
+	CreateRateLimit           string               `json:"createRateLimit,omitempty"`
+	NamePattern               string               `json:"namePattern,omitempty"`
+	NameEqualsScope           bool                 `json:"nameEqualsScope"`
+	UniqueLabel               string               `json:"uniqueLabel,omitempty"`
+	Policies                  []PolicyConfig       `json:"policies,omitempty"`
+	PerValueMax               *PerValueMaxConfig   `json:"perValueMax,omitempty"`
+	EquivalentGVKs            []string             `json:"equivalentGVKs,omitempty"`
+	CountResources            []string             `json:"countResources,omitempty"`
+	PostListFilter            bool                 `json:"postListFilter"`
+	MetadataInformer          bool                 `json:"metadataInformer"`
+	ConfirmOnEmpty            bool                 `json:"confirmOnEmpty"`
+	ListPageSize              int64                `json:"listPageSize,omitempty"`
+	LeaseNamespace            string               `json:"leaseNamespace,omitempty"`
+	LockBackend               bool                 `json:"lockBackend"`
+	LockClusterName           string               `json:"lockClusterName,omitempty"`
+	LockTTL                   string               `json:"lockTTL,omitempty"`
+	ActiveCondition           string               `json:"activeCondition,omitempty"`
+	IgnoreTerminating         bool                 `json:"ignoreTerminating"`
+	RecognizeReplacement      bool                 `json:"recognizeReplacement"`
+	WaitForTerminating        string               `json:"waitForTerminating,omitempty"`
+	DecisionLog               bool                 `json:"decisionLog"`
+	DecisionLogFormat         DecisionLogFormat    `json:"decisionLogFormat"`
+	NamespaceCount            string               `json:"namespaceCountAnnotation,omitempty"`
+	ExemptFieldManagers       []string             `json:"exemptFieldManagers,omitempty"`
+	ExemptUsers               []string             `json:"exemptUsers,omitempty"`
+	ExemptGroups              []string             `json:"exemptGroups,omitempty"`
+	BypassSecret              bool                 `json:"bypassSecret"`
+}
+
+// PerValueMaxConfig describes the limits set with WithPerValueMax.
+type PerValueMaxConfig struct {
+	LabelKey     string         `json:"labelKey"`
+	Limits       map[string]int `json:"limits,omitempty"`
+	DefaultLimit int            `json:"defaultLimit"`
+}
+
+// PolicyConfig describes a policy added with WithPolicy.
+type PolicyConfig struct {
+	Name     string `json:"name"`
+	Max      int    `json:"max"`
+	Selector string `json:"selector,omitempty"`
+}
+
+const (
+	ScopeNamespace  = "namespace"
+	ScopeCluster    = "cluster"
+	ScopeAnnotation = "annotation"
+)
+
+// EffectiveConfig returns a snapshot of the webhook's configuration, with
+// defaults filled in. Fields derived from the scheme and REST mapper, such
+// as the GVK and scope, are only populated after the webhook is set up.
+// A MaxConcurrent value of 0 means list calls are not limited.
+func (w *Webhook) EffectiveConfig() Config {
+	var equivalentGVKs []string
+	for _, gvk := range w.equivalentGVKs {
+		equivalentGVKs = append(equivalentGVKs, gvk.String())
+	}
+	scope := ScopeNamespace
+	if w.clusterWide {
+		scope = ScopeCluster
+	}
+	if !w.namespaced {
+		scope = ScopeCluster
+		if w.scopeAnnotation != "" {
+			scope = ScopeAnnotation
+		}
+	}
+	var mutatePath string
+	if w.mutating() {
+		mutatePath = generateMutatePath(w.gvk)
+	}
+	var uniqueLabel string
+	if w.uniqueLabelKey != "" {
+		uniqueLabel = w.uniqueLabelKey + "=" + w.uniqueLabelValue
+	}
+	var countResources []string
+	for _, source := range w.countResources {
+		countResources = append(countResources, source.gvk.String()+" "+source.namePrefix+"*")
+	}
+	decisionLogFormat := w.decisionLogFormat
+	if decisionLogFormat == "" {
+		decisionLogFormat = DecisionLogFormatJSON
+	}
+	var perValueMax *PerValueMaxConfig
+	if w.perValueKey != "" {
+		limits := make(map[string]int, len(w.perValueLimits))
+		for k, v := range w.perValueLimits {
+			limits[k] = v
+		}
+		perValueMax = &PerValueMaxConfig{
+			LabelKey:     w.perValueKey,
+			Limits:       limits,
+			DefaultLimit: w.perValueDefault,
+		}
+	}
+	decodeFailurePolicy := w.decodeFailurePolicy
+	if decodeFailurePolicy == "" {
+		decodeFailurePolicy = DecodeFailureError
+	}
+	var lockTTL string
+	if w.lockBackend != nil {
+		lockTTL = w.effectiveLockTTL().String()
+	}
+	var createRateLimit string
+	if w.createRateLimit != nil {
+		createRateLimit = fmt.Sprintf("%d/%s", w.createRateLimit.max, w.createRateLimit.window)
+	}
+	var ownerChainScope string
+	if w.ownerChainDepth > 0 {
+		ownerChainScope = fmt.Sprintf("%d %s", w.ownerChainDepth, w.ownerChainRoot.String())
+	}
+	var waitForTerminating string
+	if w.waitForTerminating > 0 {
+		waitForTerminating = w.waitForTerminating.String()
+	}
+	var policies []PolicyConfig
+	for _, p := range w.policies {
+		pc := PolicyConfig{
+			Name: p.name,
+			Max:  p.max(),
+		}
+		if p.Selector != nil {
+			pc.Selector = p.Selector.String()
+		}
+		policies = append(policies, pc)
+	}
+	return Config{
+		Group:                     w.gvk.Group,
+		Version:                   w.gvk.Version,
+		Kind:                      w.gvk.Kind,
+		Path:                      generateValidatePath(w.gvk),
+		MutatePath:                mutatePath,
+		Namespaced:                w.namespaced,
+		CustomScheme:              w.scheme != nil,
+		Scope:                     scope,
+		ScopeAnnotation:           w.scopeAnnotation,
+		ScopeField:                strings.Join(w.scopeField, "."),
+		ScopeNamespaceField:       strings.Join(w.scopeNamespaceField, "."),
+		ClusterWide:               w.clusterWide,
+		ScopeByUser:               w.scopeByUser,
+		OwnerChainScope:           ownerChainScope,
+		OwnerChainRequired:        w.ownerChainRequired,
+		Sharded:                   w.shardFunc != nil,
+		Drained:                   w.Drained(),
+		PausedNamespaces:          w.PausedNamespaces(),
+		EnforcementMode:           w.EnforcementMode(),
+		EnforcementEnvVar:         w.enforcementEnvVar,
+		DecodeFailurePolicy:       decodeFailurePolicy,
+		ExcludeSystemNamespaces:   w.excludeSystemNamespaces,
+		RequireNamespace:          w.requireNamespace,
+		FixedNamespace:            w.fixedNamespace,
+		SkipTerminatingNamespaces: w.skipTerminatingNamespaces,
+		ImmutableIdentity:         w.immutableIdentity,
+		Impersonate:               w.impersonate,
+		AdmittedAt:                w.admittedAtAnnotation,
+		Verdict:                   w.verdictAnnotation,
+		Duplicate:                 w.duplicateAnnotation,
+		MaxConcurrent:             w.maxConcurrent,
+		CreateRateLimit:           createRateLimit,
+		NamePattern:               w.namePattern,
+		NameEqualsScope:           w.nameEqualsScope,
+		UniqueLabel:               uniqueLabel,
+		Policies:                  policies,
+		PerValueMax:               perValueMax,
+		EquivalentGVKs:            equivalentGVKs,
+		CountResources:            countResources,
+		PostListFilter:            w.postListFilter != nil,
+		MetadataInformer:          w.metadataClient != nil,
+		ConfirmOnEmpty:            w.confirmOnEmpty,
+		ListPageSize:              w.listPageSize,
+		LeaseNamespace:            w.leaseNamespace,
+		LockBackend:               w.lockBackend != nil,
+		LockClusterName:           w.lockClusterName,
+		LockTTL:                   lockTTL,
+		ActiveCondition:           w.activeCondition,
+		IgnoreTerminating:         !w.countTerminating,
+		RecognizeReplacement:      w.recognizeReplacement,
+		WaitForTerminating:        waitForTerminating,
+		DecisionLog:               w.decisionLog != nil,
+		DecisionLogFormat:         decisionLogFormat,
+		NamespaceCount:            w.namespaceCountAnnotation,
+		ExemptFieldManagers:       append([]string(nil), w.exemptFieldManagers...),
+		ExemptUsers:               append([]string(nil), w.exemptUsers...),
+		ExemptGroups:              append([]string(nil), w.exemptGroups...),
+		BypassSecret:              len(w.bypassSecret) > 0,
+	}
+}
@@ -0,0 +1,93 @@
+package highlander
+
+import (
+	"testing"
+	"time"
+
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+func TestEffectiveConfigDefaults(t *testing.T) {
+	config := newTestWebhook(t, nil).EffectiveConfig()
+	if config.Group != "" || config.Version != "v1" || config.Kind != "ConfigMap" {
+		t.Errorf("unexpected gvk %s/%s %s", config.Group, config.Version, config.Kind)
+	}
+	if !config.Namespaced || config.Scope != ScopeNamespace {
+		t.Errorf("unexpected scope %q", config.Scope)
+	}
+	if config.MutatePath != "" {
+		t.Errorf("expected no mutate path, got %q", config.MutatePath)
+	}
+	if config.EnforcementMode != EnforcementEnforce {
+		t.Errorf("unexpected enforcement mode %q", config.EnforcementMode)
+	}
+	if config.DecodeFailurePolicy != DecodeFailureError {
+		t.Errorf("unexpected decode failure policy %q", config.DecodeFailurePolicy)
+	}
+	if config.DecisionLogFormat != DecisionLogFormatJSON {
+		t.Errorf("unexpected decision log format %q", config.DecisionLogFormat)
+	}
+	if !config.IgnoreTerminating || config.MaxConcurrent != 0 || config.LockTTL != "" {
+		t.Errorf("unexpected defaults: %+v", config)
+	}
+}
+
+func TestEffectiveConfigOverrides(t *testing.T) {
+	w := newTestWebhook(t, nil,
+		WithClusterWideScope(true),
+		WithScopeField("spec", "nodeName"),
+		WithUniqueLabelValue("role", "leader"),
+		WithAdmittedAtAnnotation(true),
+		WithMaxConcurrent(4),
+		WithIgnoreTerminating(false),
+		WithLockBackend(NewMemoryLockBackend(), "east"),
+		WithCreateRateLimit(2, time.Minute),
+		WithDecodeFailurePolicy(DecodeFailureAllow),
+		WithEnforcementMode(EnforcementAdvisory),
+		WithPerValueMax("tier", map[string]int{"prod": 1}, 3),
+		WithPolicy("leaders", Policy{Max: 1, Selector: labels.SelectorFromSet(labels.Set{"role": "leader"})}),
+		WithExemptUsers("admin"),
+	)
+	w.SetDrain(true)
+	config := w.EffectiveConfig()
+
+	if config.Scope != ScopeCluster || !config.ClusterWide || config.ScopeField != "spec.nodeName" {
+		t.Errorf("unexpected scope: %+v", config)
+	}
+	if config.UniqueLabel != "role=leader" {
+		t.Errorf("unexpected unique label %q", config.UniqueLabel)
+	}
+	if config.MutatePath != generateMutatePath(configMapGVK) {
+		t.Errorf("unexpected mutate path %q", config.MutatePath)
+	}
+	if config.MaxConcurrent != 4 || config.IgnoreTerminating || !config.Drained {
+		t.Errorf("unexpected overrides: %+v", config)
+	}
+	if !config.LockBackend || config.LockClusterName != "east" || config.LockTTL != defaultLockTTL.String() {
+		t.Errorf("unexpected lock config: %+v", config)
+	}
+	if config.CreateRateLimit != "2/1m0s" {
+		t.Errorf("unexpected create rate limit %q", config.CreateRateLimit)
+	}
+	if config.DecodeFailurePolicy != DecodeFailureAllow || config.EnforcementMode != EnforcementAdvisory {
+		t.Errorf("unexpected policies: %+v", config)
+	}
+	if config.PerValueMax == nil || config.PerValueMax.LabelKey != "tier" ||
+		config.PerValueMax.Limits["prod"] != 1 || config.PerValueMax.DefaultLimit != 3 {
+		t.Errorf("unexpected per value max %+v", config.PerValueMax)
+	}
+	if len(config.Policies) != 1 || config.Policies[0].Name != "leaders" ||
+		config.Policies[0].Max != 1 || config.Policies[0].Selector != "role=leader" {
+		t.Errorf("unexpected policies %+v", config.Policies)
+	}
+	if len(config.ExemptUsers) != 1 || config.ExemptUsers[0] != "admin" {
+		t.Errorf("unexpected exempt users %v", config.ExemptUsers)
+	}
+
+	// The snapshot does not share state with the webhook
+	config.PerValueMax.Limits["prod"] = 5
+	config.ExemptUsers[0] = "other"
+	if w.perValueLimits["prod"] != 1 || w.exemptUsers[0] != "admin" {
+		t.Error("modifying the config modified the webhook")
+	}
+}
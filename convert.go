@@ -0,0 +1,51 @@
+package highlander
+
+import (
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+// toWebhookVersion converts an object sent in another served version of the
+// webhook's kind to the webhook's version, so that its fields can be
+// compared with those of the listed instances, which are always returned in
+// the webhook's version. The conversion uses the webhook's scheme, so both
+// versions and a conversion between them must be registered. If the object
+// cannot be converted, it is returned unchanged and its fields are read
+// as-is.
+func (w *Webhook) toWebhookVersion(obj *unstructured.Unstructured) *unstructured.Unstructured {
+	gvk := obj.GroupVersionKind()
+	if gvk.Version == w.gvk.Version || gvk.GroupKind() != w.gvk.GroupKind() ||
+		w.runtimeScheme == nil {
+		return obj
+	}
+	in, err := w.runtimeScheme.New(gvk)
+	if err != nil {
+		w.log.V(1).Info("Cannot convert object to the webhook's version",
+			"gvk", gvk.String(),
+			"error", err.Error(),
+		)
+		return obj
+	}
+	if err := runtime.DefaultUnstructuredConverter.FromUnstructured(obj.Object, in); err != nil {
+		w.log.V(1).Info("Cannot convert object to the webhook's version",
+			"gvk", gvk.String(),
+			"error", err.Error(),
+		)
+		return obj
+	}
+	out, err := w.runtimeScheme.ConvertToVersion(in, w.gvk.GroupVersion())
+	if err != nil {
+		w.log.V(1).Info("Cannot convert object to the webhook's version",
+			"gvk", gvk.String(),
+			"error", err.Error(),
+		)
+		return obj
+	}
+	content, err := runtime.DefaultUnstructuredConverter.ToUnstructured(out)
+	if err != nil {
+		return obj
+	}
+	converted := &unstructured.Unstructured{Object: content}
+	converted.SetGroupVersionKind(w.gvk)
+	return converted
+}
@@ -0,0 +1,137 @@
+package highlander
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	admissionv1 "k8s.io/api/admission/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/conversion"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+)
+
+var (
+	widgetV1GVK = schema.GroupVersionKind{Group: "example.com", Version: "v1", Kind: "Widget"}
+	widgetV2GVK = schema.GroupVersionKind{Group: "example.com", Version: "v2", Kind: "Widget"}
+)
+
+// widgetV1 has its zone at spec.zone.
+type widgetV1 struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+	Spec              struct {
+		Zone string `json:"zone,omitempty"`
+	} `json:"spec"`
+}
+
+func (in *widgetV1) DeepCopyObject() runtime.Object {
+	out := *in
+	in.ObjectMeta.DeepCopyInto(&out.ObjectMeta)
+	return &out
+}
+
+type widgetV1List struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []widgetV1 `json:"items"`
+}
+
+func (in *widgetV1List) DeepCopyObject() runtime.Object {
+	out := *in
+	out.Items = make([]widgetV1, len(in.Items))
+	for i := range in.Items {
+		out.Items[i] = *in.Items[i].DeepCopyObject().(*widgetV1)
+	}
+	return &out
+}
+
+// widgetV2 moved the zone to spec.location.zone.
+type widgetV2 struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+	Spec              struct {
+		Location struct {
+			Zone string `json:"zone,omitempty"`
+		} `json:"location"`
+	} `json:"spec"`
+}
+
+func (in *widgetV2) DeepCopyObject() runtime.Object {
+	out := *in
+	in.ObjectMeta.DeepCopyInto(&out.ObjectMeta)
+	return &out
+}
+
+func newWidgetScheme(t *testing.T) *runtime.Scheme {
+	t.Helper()
+	scheme := runtime.NewScheme()
+	scheme.AddKnownTypeWithName(widgetV1GVK, &widgetV1{})
+	scheme.AddKnownTypeWithName(widgetV1GVK.GroupVersion().WithKind("WidgetList"), &widgetV1List{})
+	scheme.AddKnownTypeWithName(widgetV2GVK, &widgetV2{})
+	err := scheme.AddConversionFunc((*widgetV2)(nil), (*widgetV1)(nil),
+		func(a, b interface{}, _ conversion.Scope) error {
+			in, out := a.(*widgetV2), b.(*widgetV1)
+			out.ObjectMeta = in.ObjectMeta
+			out.Spec.Zone = in.Spec.Location.Zone
+			return nil
+		})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return scheme
+}
+
+func widgetRequest(t *testing.T, obj runtime.Object, gvk schema.GroupVersionKind) admission.Request {
+	t.Helper()
+	obj.GetObjectKind().SetGroupVersionKind(gvk)
+	data, err := json.Marshal(obj)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return admission.Request{
+		AdmissionRequest: admissionv1.AdmissionRequest{
+			Operation: admissionv1.Create,
+			Kind: metav1.GroupVersionKind{
+				Group:   gvk.Group,
+				Version: gvk.Version,
+				Kind:    gvk.Kind,
+			},
+			Namespace: "default",
+			Name:      "new",
+			Object:    runtime.RawExtension{Raw: data},
+		},
+	}
+}
+
+func TestConvertToWebhookVersion(t *testing.T) {
+	scheme := newWidgetScheme(t)
+	mapper := meta.NewDefaultRESTMapper(nil)
+	mapper.Add(widgetV1GVK, meta.RESTScopeNamespace)
+	existing := &widgetV1{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "existing"}}
+	existing.Spec.Zone = "east"
+	c := testClient{
+		Client: fake.NewClientBuilder().WithScheme(scheme).WithObjects(existing).Build(),
+		mapper: mapper,
+	}
+	w := newTestWebhookFor(t, &widgetV1{}, c,
+		WithScheme(scheme),
+		WithScopeField("spec", "zone"))
+
+	v2 := func(zone string) *widgetV2 {
+		obj := &widgetV2{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "new"}}
+		obj.Spec.Location.Zone = zone
+		return obj
+	}
+	// The zone of a v2 object is read from where it is in v1
+	expectDenied(t, w.Handle(context.Background(), widgetRequest(t, v2("east"), widgetV2GVK)))
+	expectAllowed(t, w.Handle(context.Background(), widgetRequest(t, v2("west"), widgetV2GVK)))
+
+	v1 := &widgetV1{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "new"}}
+	v1.Spec.Zone = "east"
+	expectDenied(t, w.Handle(context.Background(), widgetRequest(t, v1, widgetV1GVK)))
+}
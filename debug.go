@@ -0,0 +1,23 @@
+package highlander
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+// DebugHandler returns an http.Handler which writes a JSON list of the
+// effective configuration of each of the given webhooks. The webhooks
+// must have already been set up. It can be mounted on the manager's metrics
+// server using mgr.AddMetricsExtraHandler.
+func DebugHandler(webhooks ...*Webhook) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		configs := make([]Config, 0, len(webhooks))
+		for _, w := range webhooks {
+			configs = append(configs, w.EffectiveConfig())
+		}
+		rw.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(rw).Encode(configs); err != nil {
+			http.Error(rw, err.Error(), http.StatusInternalServerError)
+		}
+	})
+}
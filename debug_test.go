@@ -0,0 +1,55 @@
+package highlander
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+func TestDebugHandler(t *testing.T) {
+	namespaced := newTestWebhook(t, nil,
+		WithNamePattern("^singleton$"),
+		WithMaxConcurrent(2),
+		WithExcludeSystemNamespaces(true))
+	cluster := newTestWebhookFor(t, &corev1.PersistentVolume{}, newTestClient(),
+		WithScopeAnnotation(NamespaceAnnotation))
+
+	rec := httptest.NewRecorder()
+	DebugHandler(namespaced, cluster).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("unexpected status %d: %s", rec.Code, rec.Body.String())
+	}
+	if ct := rec.Header().Get("Content-Type"); ct != "application/json" {
+		t.Errorf("unexpected content type %q", ct)
+	}
+	var configs []Config
+	if err := json.Unmarshal(rec.Body.Bytes(), &configs); err != nil {
+		t.Fatal(err)
+	}
+	if len(configs) != 2 {
+		t.Fatalf("expected 2 configs, got %d", len(configs))
+	}
+
+	ns := configs[0]
+	if ns.Kind != "ConfigMap" || !ns.Namespaced || ns.Scope != ScopeNamespace {
+		t.Errorf("unexpected kind or scope: %+v", ns)
+	}
+	if ns.Path != generateValidatePath(configMapGVK) {
+		t.Errorf("unexpected path %q", ns.Path)
+	}
+	if ns.NamePattern != "^singleton$" || ns.MaxConcurrent != 2 || !ns.ExcludeSystemNamespaces {
+		t.Errorf("options are not reflected: %+v", ns)
+	}
+	if ns.EnforcementMode != EnforcementEnforce || ns.DecodeFailurePolicy != DecodeFailureError {
+		t.Errorf("defaults are not filled in: %+v", ns)
+	}
+
+	pv := configs[1]
+	if pv.Kind != "PersistentVolume" || pv.Namespaced || pv.Scope != ScopeAnnotation ||
+		pv.ScopeAnnotation != NamespaceAnnotation {
+		t.Errorf("unexpected kind or scope: %+v", pv)
+	}
+}
@@ -0,0 +1,173 @@
+package highlander
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+)
+
+const (
+	// DecisionDenied is recorded when a request is denied.
+	DecisionDenied = "denied"
+	// DecisionAdvisory is recorded when a request which would have been
+	// denied is allowed because the webhook is in advisory mode.
+	DecisionAdvisory = "advisory"
+	// DecisionBypassed is recorded when a request which would have been
+	// denied is allowed because the requesting user is exempt.
+	DecisionBypassed = "bypassed"
+)
+
+// DecisionRecord is written to the decision log, as one JSON object per line,
+// for each denied, advisory, or bypassed request.
+type DecisionRecord struct {
+	Timestamp time.Time `json:"timestamp"`
+	Decision  string    `json:"decision"`
+	Reason    string    `json:"reason"`
+	User      string    `json:"user"`
+	Group     string    `json:"group"`
+	Version   string    `json:"version"`
+	Kind      string    `json:"kind"`
+	Namespace string    `json:"namespace,omitempty"`
+	Name      string    `json:"name,omitempty"`
+	Conflicts []string  `json:"conflicts,omitempty"`
+}
+
+type decisionLog struct {
+	mu   sync.Mutex
+	out  io.Writer
+	path string
+	sync bool
+	file *os.File
+}
+
+func (l *decisionLog) open() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.path == "" || l.file != nil {
+		return nil
+	}
+	f, err := os.OpenFile(l.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o644)
+	if err != nil {
+		return err
+	}
+	l.file = f
+	l.out = f
+	return nil
+}
+
+func (l *decisionLog) write(record interface{}) error {
+	data, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	data = append(data, '\n')
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.out == nil {
+		return nil
+	}
+	if _, err := l.out.Write(data); err != nil {
+		return err
+	}
+	if l.sync && l.file != nil {
+		return l.file.Sync()
+	}
+	return nil
+}
+
+// DecisionLogFormat determines how records are written to the decision log.
+type DecisionLogFormat string
+
+const (
+	// DecisionLogFormatJSON writes each record as a DecisionRecord. This is
+	// the default.
+	DecisionLogFormatJSON DecisionLogFormat = "json"
+	// DecisionLogFormatAudit writes each record as an
+	// audit.k8s.io/v1 Event at the ResponseComplete stage, so that the log
+	// can be ingested by existing audit pipelines. The decision and any
+	// conflicting instances are recorded in the event's annotations.
+	DecisionLogFormatAudit DecisionLogFormat = "audit"
+)
+
+// WithDecisionLogFormat sets the format of the decision log.
+func WithDecisionLogFormat(format DecisionLogFormat) Option {
+	return func(w *Webhook) {
+		w.decisionLogFormat = format
+	}
+}
+
+// WithDecisionLog writes a DecisionRecord to the given writer for each
+// denied, advisory, or bypassed request. Writes are serialized, so the writer
+// does not need to be safe for concurrent use.
+func WithDecisionLog(out io.Writer) Option {
+	return func(w *Webhook) {
+		w.decisionLog = &decisionLog{out: out}
+	}
+}
+
+// WithDecisionLogFile appends a DecisionRecord to the file at the given path
+// for each denied, advisory, or bypassed request. The file is created if it
+// does not exist, and is opened when the webhook is set up. If sync is true,
+// the file is synced to disk after each record.
+func WithDecisionLogFile(path string, sync bool) Option {
+	return func(w *Webhook) {
+		w.decisionLog = &decisionLog{path: path, sync: sync}
+	}
+}
+
+// deny returns a Denied response with the given reason, recording the
+// decision in the decision log. In advisory mode, the request is allowed
+// with a warning instead.
+func (w *Webhook) deny(
+	ctx context.Context,
+	req admission.Request,
+	reason string,
+	conflicts []string,
+) admission.Response {
+	if w.EnforcementMode() == EnforcementAdvisory {
+		w.logDecision(ctx, req, DecisionAdvisory, reason, conflicts)
+		return admission.Allowed("").WithWarnings("advisory: would be denied: " + reason)
+	}
+	w.logDecision(ctx, req, DecisionDenied, reason, conflicts)
+	return admission.Denied(reason)
+}
+
+func (w *Webhook) logDecision(
+	ctx context.Context,
+	req admission.Request,
+	decision string,
+	reason string,
+	conflicts []string,
+) {
+	if w.decisionLog == nil || isPreview(ctx) {
+		return
+	}
+	record := DecisionRecord{
+		Timestamp: time.Now().UTC(),
+		Decision:  decision,
+		Reason:    reason,
+		User:      req.UserInfo.Username,
+		Group:     req.Kind.Group,
+		Version:   req.Kind.Version,
+		Kind:      req.Kind.Kind,
+		Namespace: req.Namespace,
+		Name:      req.Name,
+		Conflicts: conflicts,
+	}
+	var err error
+	switch w.decisionLogFormat {
+	case DecisionLogFormatAudit:
+		err = w.decisionLog.write(newAuditEvent(req, record))
+	default:
+		err = w.decisionLog.write(record)
+	}
+	if err != nil {
+		w.log.Error(err, "Failed to write decision log")
+	}
+}
@@ -0,0 +1,95 @@
+package highlander
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+func readDecisions(t *testing.T, r io.Reader) []DecisionRecord {
+	t.Helper()
+	var records []DecisionRecord
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		record := DecisionRecord{}
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			t.Fatalf("invalid record %q: %v", scanner.Text(), err)
+		}
+		records = append(records, record)
+	}
+	return records
+}
+
+func TestDecisionLog(t *testing.T) {
+	buf := &bytes.Buffer{}
+	w := newTestWebhook(t, []client.Object{configMap("default", "existing")},
+		WithDecisionLog(buf),
+		WithExemptUsers("admin"))
+
+	req := createRequest(t, configMap("default", "new"))
+	req.UserInfo.Username = "alice"
+	expectDenied(t, w.Handle(context.Background(), req))
+	req.UserInfo.Username = "admin"
+	expectAllowed(t, w.Handle(context.Background(), req))
+	// Allowed creates are not recorded
+	expectAllowed(t, w.Handle(context.Background(), createRequest(t, configMap("other", "new"))))
+
+	records := readDecisions(t, buf)
+	if len(records) != 2 {
+		t.Fatalf("expected 2 records, got %d", len(records))
+	}
+	denied := records[0]
+	if denied.Decision != DecisionDenied || denied.User != "alice" ||
+		denied.Kind != "ConfigMap" || denied.Version != "v1" ||
+		denied.Namespace != "default" || denied.Name != "new" ||
+		denied.Reason == "" || denied.Timestamp.IsZero() {
+		t.Errorf("unexpected record %+v", denied)
+	}
+	if len(denied.Conflicts) != 1 || denied.Conflicts[0] != "existing" {
+		t.Errorf("unexpected conflicts %v", denied.Conflicts)
+	}
+	if records[1].Decision != DecisionBypassed || records[1].User != "admin" {
+		t.Errorf("unexpected record %+v", records[1])
+	}
+}
+
+func TestDecisionLogAdvisory(t *testing.T) {
+	buf := &bytes.Buffer{}
+	w := newTestWebhook(t, []client.Object{configMap("default", "existing")},
+		WithDecisionLog(buf),
+		WithEnforcementMode(EnforcementAdvisory))
+	expectAllowed(t, w.Handle(context.Background(), createRequest(t, configMap("default", "new"))))
+	records := readDecisions(t, buf)
+	if len(records) != 1 || records[0].Decision != DecisionAdvisory {
+		t.Errorf("expected an advisory record, got %+v", records)
+	}
+}
+
+func TestDecisionLogFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "decisions.log")
+	if err := os.WriteFile(path, []byte(`{"decision":"denied"}`+"\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	w := newTestWebhook(t, []client.Object{configMap("default", "existing")},
+		WithDecisionLogFile(path, true))
+	defer w.decisionLog.file.Close()
+	expectDenied(t, w.Handle(context.Background(), createRequest(t, configMap("default", "new"))))
+
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	// Records are appended to the existing file
+	records := readDecisions(t, f)
+	if len(records) != 2 || records[1].Name != "new" {
+		t.Errorf("expected the record to be appended, got %+v", records)
+	}
+}
@@ -0,0 +1,61 @@
+package highlander
+
+import (
+	"os"
+	"strings"
+)
+
+// EnforcementMode determines what the webhook does with requests it would
+// deny.
+type EnforcementMode string
+
+const (
+	// EnforcementEnforce denies requests. This is the default.
+	EnforcementEnforce EnforcementMode = "enforce"
+	// EnforcementAdvisory allows requests which would be denied, with a
+	// warning explaining why they would have been denied.
+	EnforcementAdvisory EnforcementMode = "advisory"
+	// EnforcementOff allows all requests without checking them.
+	EnforcementOff EnforcementMode = "off"
+)
+
+// WithEnforcementMode sets the enforcement mode of the webhook.
+func WithEnforcementMode(mode EnforcementMode) Option {
+	return func(w *Webhook) {
+		w.enforcementMode = mode
+	}
+}
+
+// WithEnforcementEnvVar reads the enforcement mode from the given environment
+// variable each time a request is handled, overriding the mode set with
+// WithEnforcementMode. The variable can be set to "enforce", "advisory", or
+// "off". If it is unset or empty, the configured mode is used.
+func WithEnforcementEnvVar(name string) Option {
+	return func(w *Webhook) {
+		w.enforcementEnvVar = name
+	}
+}
+
+// EnforcementMode returns the enforcement mode currently in effect.
+func (w *Webhook) EnforcementMode() EnforcementMode {
+	if w.enforcementEnvVar != "" {
+		if value := os.Getenv(w.enforcementEnvVar); value != "" {
+			switch mode := EnforcementMode(strings.ToLower(value)); mode {
+			case EnforcementEnforce, EnforcementAdvisory, EnforcementOff:
+				return mode
+			default:
+				if w.log == nil {
+					break
+				}
+				w.log.Info("Ignoring invalid enforcement mode",
+					"variable", w.enforcementEnvVar,
+					"value", value,
+				)
+			}
+		}
+	}
+	if w.enforcementMode == "" {
+		return EnforcementEnforce
+	}
+	return w.enforcementMode
+}
@@ -0,0 +1,63 @@
+package highlander
+
+import (
+	"context"
+	"os"
+	"testing"
+
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+func setEnv(t *testing.T, key, value string) {
+	t.Helper()
+	if err := os.Setenv(key, value); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Unsetenv(key) })
+}
+
+func TestEnforcementModes(t *testing.T) {
+	existing := []client.Object{configMap("default", "existing")}
+	req := createRequest(t, configMap("default", "new"))
+
+	w := newTestWebhook(t, existing)
+	expectDenied(t, w.Handle(context.Background(), req))
+
+	w = newTestWebhook(t, existing, WithEnforcementMode(EnforcementAdvisory))
+	resp := w.Handle(context.Background(), req)
+	expectAllowed(t, resp)
+	if len(resp.Warnings) != 1 || resp.Warnings[0] != "advisory: would be denied: "+ErrThereCanBeOnlyOne.Error() {
+		t.Errorf("unexpected warnings %v", resp.Warnings)
+	}
+
+	w = newTestWebhook(t, existing, WithEnforcementMode(EnforcementOff), WithNamePattern("^valid$"))
+	resp = w.Handle(context.Background(), req)
+	expectAllowed(t, resp)
+	if len(resp.Warnings) != 0 {
+		t.Errorf("expected no warnings when enforcement is off, got %v", resp.Warnings)
+	}
+}
+
+func TestEnforcementEnvVar(t *testing.T) {
+	const variable = "HIGHLANDER_TEST_ENFORCEMENT"
+	w := newTestWebhook(t, []client.Object{configMap("default", "existing")},
+		WithEnforcementMode(EnforcementAdvisory),
+		WithEnforcementEnvVar(variable))
+	req := createRequest(t, configMap("default", "new"))
+
+	// Unset, the configured mode is used
+	if mode := w.EnforcementMode(); mode != EnforcementAdvisory {
+		t.Errorf("unexpected mode %q", mode)
+	}
+	// The variable is read for each request
+	setEnv(t, variable, "Enforce")
+	expectDenied(t, w.Handle(context.Background(), req))
+	setEnv(t, variable, "off")
+	if mode := w.EnforcementMode(); mode != EnforcementOff {
+		t.Errorf("unexpected mode %q", mode)
+	}
+	setEnv(t, variable, "invalid")
+	if mode := w.EnforcementMode(); mode != EnforcementAdvisory {
+		t.Errorf("expected invalid values to be ignored, got %q", mode)
+	}
+}
@@ -0,0 +1,95 @@
+package highlander
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+// ExternalDataQuery describes an object which would be created, for use with
+// ExternalDataHandler.
+type ExternalDataQuery struct {
+	Group       string            `json:"group"`
+	Version     string            `json:"version"`
+	Kind        string            `json:"kind"`
+	Namespace   string            `json:"namespace,omitempty"`
+	Name        string            `json:"name,omitempty"`
+	Labels      map[string]string `json:"labels,omitempty"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+}
+
+// ExternalDataResponse is returned by ExternalDataHandler.
+type ExternalDataResponse struct {
+	Allowed   bool     `json:"allowed"`
+	Reason    string   `json:"reason,omitempty"`
+	Conflicts []string `json:"conflicts,omitempty"`
+	Warnings  []string `json:"warnings,omitempty"`
+}
+
+// ExternalDataHandler returns an http.Handler which reports whether a create
+// would be allowed by the webhook guarding the queried kind, without running
+// an admission webhook. It accepts a JSON-encoded ExternalDataQuery in the
+// body of a POST request and responds with an ExternalDataResponse, so that
+// the checks can be used by policy engines which call out to external data
+// providers. Only the uniqueness checks are run; checks based on the request
+// itself, such as exemptions and name patterns, are not. The check has no
+// side effects, and the webhooks must already be set up.
+func ExternalDataHandler(webhooks ...*Webhook) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(rw, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		var query ExternalDataQuery
+		if err := json.NewDecoder(r.Body).Decode(&query); err != nil {
+			http.Error(rw, err.Error(), http.StatusBadRequest)
+			return
+		}
+		gk := schema.GroupKind{Group: query.Group, Kind: query.Kind}
+		var w *Webhook
+		for _, wh := range webhooks {
+			if wh.gvk.GroupKind() == gk {
+				w = wh
+				break
+			}
+		}
+		if w == nil {
+			http.Error(rw, fmt.Sprintf("no webhook guards %s", gk.String()), http.StatusNotFound)
+			return
+		}
+
+		obj := &unstructured.Unstructured{}
+		obj.SetGroupVersionKind(gk.WithVersion(query.Version))
+		obj.SetNamespace(query.Namespace)
+		obj.SetName(query.Name)
+		obj.SetLabels(query.Labels)
+		obj.SetAnnotations(query.Annotations)
+
+		resp := ExternalDataResponse{Allowed: true}
+		warnings, err := w.validateCreate(r.Context(), obj, validateOptions{
+			reader: w.cli,
+			cached: true,
+			dryRun: true,
+		})
+		var conflict *ConflictError
+		switch {
+		case errors.As(err, &conflict):
+			resp.Allowed = false
+			resp.Reason = conflict.Error()
+			resp.Conflicts = conflict.Conflicts
+		case err != nil:
+			http.Error(rw, err.Error(), http.StatusInternalServerError)
+			return
+		default:
+			resp.Warnings = warnings
+		}
+		rw.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(rw).Encode(resp); err != nil {
+			http.Error(rw, err.Error(), http.StatusInternalServerError)
+		}
+	})
+}
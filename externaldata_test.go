@@ -0,0 +1,58 @@
+package highlander
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+func TestExternalDataHandler(t *testing.T) {
+	w := newTestWebhook(t, []client.Object{configMap("default", "existing")})
+	handler := ExternalDataHandler(w)
+
+	query := func(q ExternalDataQuery) (int, ExternalDataResponse) {
+		t.Helper()
+		body, err := json.Marshal(q)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/", bytes.NewReader(body)))
+		resp := ExternalDataResponse{}
+		if rec.Code == http.StatusOK {
+			if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return rec.Code, resp
+	}
+
+	code, resp := query(ExternalDataQuery{Version: "v1", Kind: "ConfigMap", Namespace: "default", Name: "new"})
+	if code != http.StatusOK || resp.Allowed || resp.Reason != ErrThereCanBeOnlyOne.Error() ||
+		len(resp.Conflicts) != 1 || resp.Conflicts[0] != "existing" {
+		t.Errorf("expected a conflict, got %d %+v", code, resp)
+	}
+	code, resp = query(ExternalDataQuery{Version: "v1", Kind: "ConfigMap", Namespace: "other", Name: "new"})
+	if code != http.StatusOK || !resp.Allowed {
+		t.Errorf("expected the create to be allowed, got %d %+v", code, resp)
+	}
+	if code, _ := query(ExternalDataQuery{Version: "v1", Kind: "Secret", Namespace: "default"}); code != http.StatusNotFound {
+		t.Errorf("expected kinds without a webhook to be rejected, got %d", code)
+	}
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+	if rec.Code != http.StatusMethodNotAllowed {
+		t.Errorf("expected GET to be rejected, got %d", rec.Code)
+	}
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/", strings.NewReader("{")))
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("expected an invalid query to be rejected, got %d", rec.Code)
+	}
+}
@@ -4,7 +4,10 @@ go 1.16
 
 require (
 	github.com/go-logr/logr v0.4.0
+	github.com/prometheus/client_golang v1.11.0
+	golang.org/x/sync v0.0.0-20201207232520-09787c993a3a
 	k8s.io/api v0.21.3
 	k8s.io/apimachinery v0.21.3
+	k8s.io/client-go v0.21.3
 	sigs.k8s.io/controller-runtime v0.9.5
 )
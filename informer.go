@@ -0,0 +1,104 @@
+package highlander
+
+import (
+	"context"
+	"errors"
+	"sync"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/metadata"
+	"k8s.io/client-go/metadata/metadatainformer"
+	"sigs.k8s.io/controller-runtime/pkg/manager"
+)
+
+var (
+	_ manager.Runnable               = (*Webhook)(nil)
+	_ manager.LeaderElectionRunnable = (*Webhook)(nil)
+)
+
+// WithMetadataInformer counts existing instances of the guarded type using a
+// metadata-only informer owned by the webhook, instead of listing them with
+// the webhook's client. This provides cache-backed reads without a manager.
+// The informer runs while Start is running; SetupWithManager adds the
+// webhook to the manager so that this happens automatically. Until the
+// informer has synced, the webhook's client is used instead.
+//
+// Only object metadata is available to the webhook when using the informer,
+// so options which read other fields, such as WithScopeField and
+// WithActiveCondition, will not see them.
+func WithMetadataInformer(client metadata.Interface) Option {
+	return func(w *Webhook) {
+		w.metadataClient = client
+	}
+}
+
+// Start runs the webhook's metadata informer and renews the locks of
+// existing instances, if configured, until the context is done. It returns
+// immediately if neither is configured.
+func (w *Webhook) Start(ctx context.Context) error {
+	var wg sync.WaitGroup
+	if w.informer != nil {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			w.informer.Informer().Run(ctx.Done())
+		}()
+	}
+	if w.lockBackend != nil {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			w.renewLocks(ctx)
+		}()
+	}
+	wg.Wait()
+	return nil
+}
+
+// NeedLeaderElection implements manager.LeaderElectionRunnable. Webhooks
+// serve requests on every replica, so the informer must always run.
+func (w *Webhook) NeedLeaderElection() bool {
+	return false
+}
+
+func (w *Webhook) setupInformer() {
+	factory := metadatainformer.NewSharedInformerFactory(w.metadataClient, 0)
+	w.informer = factory.ForResource(w.gvr)
+}
+
+// listFromInformer lists instances of the guarded type from the metadata
+// informer. It returns false if the informer is not configured or has not
+// synced yet.
+func (w *Webhook) listFromInformer(namespace string) ([]unstructured.Unstructured, bool, error) {
+	if w.informer == nil || !w.informer.Informer().HasSynced() {
+		return nil, false, nil
+	}
+	var objs []runtime.Object
+	var err error
+	if namespace == "" {
+		objs, err = w.informer.Lister().List(labels.Everything())
+	} else {
+		objs, err = w.informer.Lister().ByNamespace(namespace).List(labels.Everything())
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	items := make([]unstructured.Unstructured, 0, len(objs))
+	for _, obj := range objs {
+		pom, ok := obj.(*metav1.PartialObjectMetadata)
+		if !ok {
+			return nil, false, errors.New("unexpected object type in metadata informer")
+		}
+		content, err := runtime.DefaultUnstructuredConverter.ToUnstructured(pom)
+		if err != nil {
+			return nil, false, err
+		}
+		item := unstructured.Unstructured{Object: content}
+		item.SetGroupVersionKind(w.gvk)
+		items = append(items, item)
+	}
+	return items, true, nil
+}
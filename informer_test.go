@@ -0,0 +1,58 @@
+package highlander
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/wait"
+	metadatafake "k8s.io/client-go/metadata/fake"
+)
+
+func partialConfigMap(namespace, name string) *metav1.PartialObjectMetadata {
+	return &metav1.PartialObjectMetadata{
+		TypeMeta: metav1.TypeMeta{APIVersion: "v1", Kind: "ConfigMap"},
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace: namespace,
+			Name:      name,
+		},
+	}
+}
+
+func TestMetadataInformer(t *testing.T) {
+	scheme := runtime.NewScheme()
+	if err := metav1.AddMetaToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+	metadataClient := metadatafake.NewSimpleMetadataClient(scheme, partialConfigMap("default", "existing"))
+	// The webhook's client has no instances, so conflicts can only be found
+	// by the informer
+	w := newTestWebhookFor(t, &corev1.ConfigMap{}, newTestClient(),
+		WithMetadataInformer(metadataClient))
+
+	// Until the informer has synced, the client is used
+	expectAllowed(t, w.Handle(context.Background(), createRequest(t, configMap("default", "new"))))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		done <- w.Start(ctx)
+	}()
+	defer func() {
+		cancel()
+		if err := <-done; err != nil {
+			t.Error(err)
+		}
+	}()
+	if err := wait.PollImmediate(10*time.Millisecond, 5*time.Second, func() (bool, error) {
+		return w.informer.Informer().HasSynced(), nil
+	}); err != nil {
+		t.Fatal("informer did not sync")
+	}
+
+	expectDenied(t, w.Handle(context.Background(), createRequest(t, configMap("default", "new"))))
+	expectAllowed(t, w.Handle(context.Background(), createRequest(t, configMap("other", "new"))))
+}
@@ -0,0 +1,164 @@
+package highlander
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"time"
+
+	coordinationv1 "k8s.io/api/coordination/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// leaseDuration is the time after which a lease can be taken over by
+// another create. It only needs to cover the time between a create being
+// admitted and the object becoming visible to other creates' checks, and
+// also delays recreating an instance which was deleted right after it was
+// created.
+const leaseDuration = 5 * time.Second
+
+// WithLease serializes creates in each scope using a coordination.k8s.io
+// Lease in the given namespace. After the uniqueness check passes, the
+// webhook must acquire the lease for the object's scope, and only the create
+// holding the lease is admitted. This closes the window in which two
+// concurrent creates can both pass the check before either is visible to
+// the other. A lease whose holder was never created, for example because it
+// was rejected by another webhook, can be taken over after 5 seconds. The
+// lease is released immediately if the create is denied by a later check of
+// this webhook, such as WithLockBackend.
+//
+// Acquiring the lease adds at least one API server round trip to every
+// admitted create. The webhook's scheme must include coordination.k8s.io/v1
+// and its ServiceAccount must be allowed to get, create and update leases in
+// the namespace. This option has no effect when policies are configured,
+// and cannot be combined with WithPerValueMax.
+func WithLease(namespace string) Option {
+	return func(w *Webhook) {
+		w.leaseNamespace = namespace
+	}
+}
+
+// acquireLease acquires the lease for the given scope on behalf of the
+// incoming object, or returns a *ConflictError if it is held by another
+// object.
+func (w *Webhook) acquireLease(
+	ctx context.Context,
+	obj *unstructured.Unstructured,
+	scope string,
+) error {
+	holder := leaseHolder(obj)
+	now := metav1.NewMicroTime(time.Now())
+	seconds := int32(leaseDuration.Seconds())
+	spec := coordinationv1.LeaseSpec{
+		HolderIdentity:       &holder,
+		LeaseDurationSeconds: &seconds,
+		AcquireTime:          &now,
+		RenewTime:            &now,
+	}
+	key := client.ObjectKey{
+		Namespace: w.leaseNamespace,
+		Name:      w.leaseName(scope),
+	}
+
+	err := w.cli.Create(ctx, &coordinationv1.Lease{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace: key.Namespace,
+			Name:      key.Name,
+		},
+		Spec: spec,
+	})
+	if err == nil || !apierrors.IsAlreadyExists(err) {
+		return err
+	}
+
+	// The lease already exists, read it directly from the API server to see
+	// if it can be taken over
+	var reader client.Reader = w.cli
+	if w.apiReader != nil {
+		reader = w.apiReader
+	}
+	lease := &coordinationv1.Lease{}
+	if err := reader.Get(ctx, key, lease); err != nil {
+		return err
+	}
+	if lease.Spec.HolderIdentity != nil &&
+		*lease.Spec.HolderIdentity != holder &&
+		!leaseExpired(lease) {
+		return w.leaseConflict(key)
+	}
+	lease.Spec = spec
+	if err := w.cli.Update(ctx, lease); err != nil {
+		if apierrors.IsConflict(err) {
+			return w.leaseConflict(key)
+		}
+		return err
+	}
+	return nil
+}
+
+// releaseLease deletes the lease for the given scope if it is held on behalf
+// of the incoming object, for a create which was denied after acquiring it.
+func (w *Webhook) releaseLease(
+	ctx context.Context,
+	obj *unstructured.Unstructured,
+	scope string,
+) {
+	key := client.ObjectKey{
+		Namespace: w.leaseNamespace,
+		Name:      w.leaseName(scope),
+	}
+	var reader client.Reader = w.cli
+	if w.apiReader != nil {
+		reader = w.apiReader
+	}
+	lease := &coordinationv1.Lease{}
+	if err := reader.Get(ctx, key, lease); err != nil {
+		w.log.Error(err, "Failed to release lease", "lease", key.String())
+		return
+	}
+	if lease.Spec.HolderIdentity == nil || *lease.Spec.HolderIdentity != leaseHolder(obj) {
+		return
+	}
+	err := w.cli.Delete(ctx, lease, client.Preconditions{
+		UID:             &lease.UID,
+		ResourceVersion: &lease.ResourceVersion,
+	})
+	if err != nil && !apierrors.IsNotFound(err) && !apierrors.IsConflict(err) {
+		w.log.Error(err, "Failed to release lease", "lease", key.String())
+	}
+}
+
+// leaseHolder returns the holder identity of the lease acquired for the
+// incoming object.
+func leaseHolder(obj *unstructured.Unstructured) string {
+	if uid := obj.GetUID(); uid != "" {
+		return string(uid)
+	}
+	return obj.GetNamespace() + "/" + obj.GetName()
+}
+
+func (w *Webhook) leaseConflict(key client.ObjectKey) error {
+	return &ConflictError{
+		Err: fmt.Errorf("%w: another instance is being created (lease %s is held)",
+			ErrThereCanBeOnlyOne, key.String()),
+	}
+}
+
+// leaseName returns the name of the lease for the given scope.
+func (w *Webhook) leaseName(scope string) string {
+	sum := sha256.Sum256([]byte(w.gvk.GroupKind().String() + "/" + scope))
+	return "highlander-" + strings.ToLower(w.gvk.Kind) + "-" + hex.EncodeToString(sum[:])[:16]
+}
+
+func leaseExpired(lease *coordinationv1.Lease) bool {
+	if lease.Spec.RenewTime == nil || lease.Spec.LeaseDurationSeconds == nil {
+		return true
+	}
+	duration := time.Duration(*lease.Spec.LeaseDurationSeconds) * time.Second
+	return lease.Spec.RenewTime.Add(duration).Before(time.Now())
+}
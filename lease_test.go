@@ -0,0 +1,125 @@
+package highlander
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	coordinationv1 "k8s.io/api/coordination/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+)
+
+// concurrentCreates handles creates of n objects in the same namespace at
+// the same time, and returns the number which were allowed.
+func concurrentCreates(t *testing.T, w *Webhook, n int) int {
+	t.Helper()
+	reqs := make([]admission.Request, n)
+	for i := range reqs {
+		reqs[i] = createRequest(t, configMap("default", fmt.Sprintf("new-%d", i)))
+	}
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	allowed := 0
+	start := make(chan struct{})
+	for i := range reqs {
+		wg.Add(1)
+		go func(req admission.Request) {
+			defer wg.Done()
+			<-start
+			if w.Handle(context.Background(), req).Allowed {
+				mu.Lock()
+				allowed++
+				mu.Unlock()
+			}
+		}(reqs[i])
+	}
+	close(start)
+	wg.Wait()
+	return allowed
+}
+
+func TestLeaseSerializesConcurrentCreates(t *testing.T) {
+	// None of the creates are visible to the others, so all of them pass the
+	// uniqueness check without a lease
+	w := newTestWebhook(t, nil)
+	if allowed := concurrentCreates(t, w, 10); allowed != 10 {
+		t.Errorf("expected all creates to be allowed without a lease, got %d", allowed)
+	}
+
+	w = newTestWebhook(t, nil, WithLease("highlander"))
+	if allowed := concurrentCreates(t, w, 10); allowed != 1 {
+		t.Errorf("expected exactly one create to be allowed, got %d", allowed)
+	}
+
+	// Creates in other scopes use other leases
+	expectAllowed(t, w.Handle(context.Background(), createRequest(t, configMap("other", "new"))))
+}
+
+func TestLeaseTakeover(t *testing.T) {
+	w := newTestWebhook(t, nil, WithLease("highlander"))
+	holder := "default/abandoned"
+	renewed := metav1.NewMicroTime(time.Now().Add(-time.Minute))
+	seconds := int32(leaseDuration.Seconds())
+	expired := &coordinationv1.Lease{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "highlander", Name: w.leaseName("default")},
+		Spec: coordinationv1.LeaseSpec{
+			HolderIdentity:       &holder,
+			LeaseDurationSeconds: &seconds,
+			RenewTime:            &renewed,
+		},
+	}
+	if err := w.cli.Create(context.Background(), expired); err != nil {
+		t.Fatal(err)
+	}
+
+	// A dry run does not take over the lease
+	req := createRequest(t, configMap("default", "new"))
+	dryRun := true
+	req.DryRun = &dryRun
+	expectAllowed(t, w.Handle(context.Background(), req))
+	lease := &coordinationv1.Lease{}
+	if err := w.cli.Get(context.Background(), client.ObjectKeyFromObject(expired), lease); err != nil {
+		t.Fatal(err)
+	}
+	if *lease.Spec.HolderIdentity != holder {
+		t.Errorf("dry run took over the lease")
+	}
+
+	expectAllowed(t, w.Handle(context.Background(), createRequest(t, configMap("default", "new"))))
+	if err := w.cli.Get(context.Background(), client.ObjectKeyFromObject(expired), lease); err != nil {
+		t.Fatal(err)
+	}
+	if *lease.Spec.HolderIdentity != "default/new" {
+		t.Errorf("expected the expired lease to be taken over, held by %q", *lease.Spec.HolderIdentity)
+	}
+	expectDenied(t, w.Handle(context.Background(), createRequest(t, configMap("default", "other"))))
+}
+
+func TestLeaseReleasedOnDenial(t *testing.T) {
+	ctx := context.Background()
+	backend := NewMemoryLockBackend()
+	w := newTestWebhook(t, nil, WithLease("highlander"), WithLockBackend(backend, "east"))
+	if ok, _ := backend.Acquire(ctx, "ConfigMap/default", "west/default/other", time.Hour); !ok {
+		t.Fatal("expected the lock to be acquired")
+	}
+
+	// The create acquires the lease, but is denied by the lock
+	expectDenied(t, w.Handle(ctx, createRequest(t, configMap("default", "new"))))
+	leases := &coordinationv1.LeaseList{}
+	if err := w.cli.List(ctx, leases); err != nil {
+		t.Fatal(err)
+	}
+	if len(leases.Items) != 0 {
+		t.Errorf("expected the lease to be released, got %d lease(s)", len(leases.Items))
+	}
+
+	// Another create is not blocked by the lease
+	if err := backend.Release(ctx, "ConfigMap/default", "west/default/other"); err != nil {
+		t.Fatal(err)
+	}
+	expectAllowed(t, w.Handle(ctx, createRequest(t, configMap("default", "other"))))
+}
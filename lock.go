@@ -0,0 +1,239 @@
+package highlander
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// LockBackend is a lock service used to enforce uniqueness beyond a single
+// API server, for example across a federation of clusters. Each lock is
+// identified by a key derived from the webhook's kind and the scope of an
+// instance, and is held on behalf of the instance which was admitted. Locks
+// expire unless they are renewed, so that a lock whose instance was deleted,
+// or was never created, does not block its scope forever.
+type LockBackend interface {
+	// Acquire acquires the lock for the key on behalf of the holder, for the
+	// given time to live. It returns false if the lock is held by a
+	// different holder. Acquiring a lock which is already held by the same
+	// holder succeeds and renews it.
+	Acquire(ctx context.Context, key, holder string, ttl time.Duration) (bool, error)
+	// Release releases the lock for the key if it is held by the holder.
+	Release(ctx context.Context, key, holder string) error
+	// IsHeld returns the current holder of the lock for the key, if any.
+	IsHeld(ctx context.Context, key string) (holder string, held bool, err error)
+}
+
+// defaultLockTTL is the time to live of locks acquired from a LockBackend,
+// unless set with WithLockTTL.
+const defaultLockTTL = time.Minute
+
+// WithLockBackend requires every admitted create to hold a lock from the
+// given backend for its scope, after the checks against the local API
+// server pass. A create whose lock is held by another instance is denied.
+// The holder of each lock is identified by the cluster name together with
+// the namespace and name of the object, so each cluster sharing the backend
+// must use a different cluster name. RedisLockBackend can be shared between
+// clusters; MemoryLockBackend is only shared within a process.
+//
+// Locks expire after the time set with WithLockTTL, one minute by default.
+// While Start is running, the webhook renews the locks of the instances
+// which exist in its cluster, and releases them once the instances are
+// being deleted. SetupWithManager adds the webhook to the manager so that
+// this happens automatically. Locks acquired for creates which were
+// rejected after admission simply expire. Dry-run requests only check
+// whether the lock is held. This option has no effect when policies are
+// configured, and cannot be combined with WithPerValueMax.
+func WithLockBackend(backend LockBackend, clusterName string) Option {
+	return func(w *Webhook) {
+		w.lockBackend = backend
+		w.lockClusterName = clusterName
+	}
+}
+
+// WithLockTTL sets the time to live of locks acquired with WithLockBackend.
+// Locks are renewed at a third of this interval. A longer time to live
+// tolerates longer outages of the webhook, but delays creating a new
+// instance in another cluster after the old one is deleted.
+func WithLockTTL(ttl time.Duration) Option {
+	return func(w *Webhook) {
+		w.lockTTL = ttl
+	}
+}
+
+func (w *Webhook) effectiveLockTTL() time.Duration {
+	if w.lockTTL > 0 {
+		return w.lockTTL
+	}
+	return defaultLockTTL
+}
+
+// LockKey returns the key of the lock held by the object when the webhook
+// is configured with WithLockBackend.
+func (w *Webhook) LockKey(ctx context.Context, obj *unstructured.Unstructured) (string, error) {
+	scope, err := w.scopeOf(ctx, obj)
+	if err != nil {
+		return "", err
+	}
+	return w.gvk.GroupKind().String() + "/" + scope, nil
+}
+
+// LockHolder returns the holder identity used for the object's lock when
+// the webhook is configured with WithLockBackend.
+func (w *Webhook) LockHolder(obj *unstructured.Unstructured) string {
+	return w.lockClusterName + "/" + obj.GetNamespace() + "/" + obj.GetName()
+}
+
+// acquireLock acquires the object's lock from the lock backend, or returns a
+// *ConflictError if it is held by another instance. If dryRun is true, the
+// lock is only checked.
+func (w *Webhook) acquireLock(
+	ctx context.Context,
+	obj *unstructured.Unstructured,
+	dryRun bool,
+) error {
+	key, err := w.LockKey(ctx, obj)
+	if err != nil {
+		return err
+	}
+	holder := w.LockHolder(obj)
+	if dryRun {
+		current, held, err := w.lockBackend.IsHeld(ctx, key)
+		if err != nil {
+			return err
+		}
+		if held && current != holder {
+			return lockConflict(key, current)
+		}
+		return nil
+	}
+	ok, err := w.lockBackend.Acquire(ctx, key, holder, w.effectiveLockTTL())
+	if err != nil {
+		return err
+	}
+	if !ok {
+		current, _, err := w.lockBackend.IsHeld(ctx, key)
+		if err != nil {
+			return lockConflict(key, "")
+		}
+		return lockConflict(key, current)
+	}
+	return nil
+}
+
+func lockConflict(key, holder string) error {
+	if holder == "" {
+		return &ConflictError{
+			Err: fmt.Errorf("%w: lock %s is held", ErrThereCanBeOnlyOne, key),
+		}
+	}
+	return &ConflictError{
+		Err: fmt.Errorf("%w: lock %s is held by %s", ErrThereCanBeOnlyOne, key, holder),
+	}
+}
+
+// renewLocks periodically renews the locks held by the instances which exist
+// in the cluster, and releases those of instances which are being deleted,
+// until the context is done.
+func (w *Webhook) renewLocks(ctx context.Context) {
+	wait.UntilWithContext(ctx, w.renewLocksOnce, w.effectiveLockTTL()/3)
+}
+
+func (w *Webhook) renewLocksOnce(ctx context.Context) {
+	items, err := w.listInstances(ctx, w.cli, true, &client.ListOptions{}, nil)
+	if err != nil {
+		w.log.Error(err, "Failed to list instances to renew their locks")
+		return
+	}
+	for i := range items {
+		item := &items[i]
+		if item.GroupVersionKind().GroupKind() != w.gvk.GroupKind() {
+			// Instances of other counted kinds were not admitted by this
+			// webhook and hold no lock
+			continue
+		}
+		key, err := w.LockKey(ctx, item)
+		if err != nil {
+			continue
+		}
+		holder := w.LockHolder(item)
+		if item.GetDeletionTimestamp() != nil {
+			if err := w.lockBackend.Release(ctx, key, holder); err != nil {
+				w.log.Error(err, "Failed to release lock", "key", key)
+			}
+			continue
+		}
+		ok, err := w.lockBackend.Acquire(ctx, key, holder, w.effectiveLockTTL())
+		if err != nil {
+			w.log.Error(err, "Failed to renew lock", "key", key)
+			continue
+		}
+		if !ok {
+			w.log.Info("Lock for existing instance is held by another instance",
+				"key", key,
+				"namespace", item.GetNamespace(),
+				"name", item.GetName(),
+			)
+		}
+	}
+}
+
+// MemoryLockBackend is a LockBackend which keeps locks in memory. It is only
+// shared by webhooks in the same process, so it cannot provide uniqueness
+// across clusters, and is mainly useful for testing.
+type MemoryLockBackend struct {
+	mu    sync.Mutex
+	locks map[string]memoryLock
+}
+
+type memoryLock struct {
+	holder  string
+	expires time.Time
+}
+
+var _ LockBackend = (*MemoryLockBackend)(nil)
+
+func NewMemoryLockBackend() *MemoryLockBackend {
+	return &MemoryLockBackend{
+		locks: map[string]memoryLock{},
+	}
+}
+
+func (b *MemoryLockBackend) Acquire(
+	_ context.Context,
+	key, holder string,
+	ttl time.Duration,
+) (bool, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	now := time.Now()
+	if current, ok := b.locks[key]; ok && current.holder != holder && current.expires.After(now) {
+		return false, nil
+	}
+	b.locks[key] = memoryLock{holder: holder, expires: now.Add(ttl)}
+	return true, nil
+}
+
+func (b *MemoryLockBackend) Release(_ context.Context, key, holder string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.locks[key].holder == holder {
+		delete(b.locks, key)
+	}
+	return nil
+}
+
+func (b *MemoryLockBackend) IsHeld(_ context.Context, key string) (string, bool, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	lock, ok := b.locks[key]
+	if !ok || !lock.expires.After(time.Now()) {
+		return "", false, nil
+	}
+	return lock.holder, true, nil
+}
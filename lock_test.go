@@ -0,0 +1,113 @@
+package highlander
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+func TestMemoryLockBackend(t *testing.T) {
+	ctx := context.Background()
+	b := NewMemoryLockBackend()
+
+	if ok, err := b.Acquire(ctx, "key", "a", time.Minute); err != nil || !ok {
+		t.Fatalf("expected the lock to be acquired, got %v, %v", ok, err)
+	}
+	if ok, _ := b.Acquire(ctx, "key", "b", time.Minute); ok {
+		t.Error("expected the lock to be held by a")
+	}
+	// The holder can renew the lock
+	if ok, _ := b.Acquire(ctx, "key", "a", time.Minute); !ok {
+		t.Error("expected the holder to renew the lock")
+	}
+	if holder, held, _ := b.IsHeld(ctx, "key"); !held || holder != "a" {
+		t.Errorf("expected the lock to be held by a, got %q, %v", holder, held)
+	}
+
+	// Only the holder can release the lock
+	if err := b.Release(ctx, "key", "b"); err != nil {
+		t.Fatal(err)
+	}
+	if _, held, _ := b.IsHeld(ctx, "key"); !held {
+		t.Error("lock was released by another holder")
+	}
+	if err := b.Release(ctx, "key", "a"); err != nil {
+		t.Fatal(err)
+	}
+	if _, held, _ := b.IsHeld(ctx, "key"); held {
+		t.Error("expected the lock to be released")
+	}
+
+	// Expired locks can be acquired by another holder
+	if ok, _ := b.Acquire(ctx, "key", "a", time.Millisecond); !ok {
+		t.Fatal("expected the lock to be acquired")
+	}
+	time.Sleep(5 * time.Millisecond)
+	if _, held, _ := b.IsHeld(ctx, "key"); held {
+		t.Error("expected the lock to expire")
+	}
+	if ok, _ := b.Acquire(ctx, "key", "b", time.Minute); !ok {
+		t.Error("expected the expired lock to be acquired by b")
+	}
+}
+
+func TestLockBackendAcrossClusters(t *testing.T) {
+	backend := NewMemoryLockBackend()
+	east := newTestWebhook(t, nil, WithLockBackend(backend, "east"))
+	west := newTestWebhook(t, nil, WithLockBackend(backend, "west"))
+
+	expectAllowed(t, east.Handle(context.Background(), createRequest(t, configMap("default", "singleton"))))
+	// Neither cluster has an instance which the other can see
+	resp := west.Handle(context.Background(), createRequest(t, configMap("default", "singleton")))
+	expectDenied(t, resp)
+	if reason := string(resp.Result.Reason); reason != ErrThereCanBeOnlyOne.Error()+
+		": lock ConfigMap/default is held by east/default/singleton" {
+		t.Errorf("unexpected reason %q", reason)
+	}
+	expectAllowed(t, west.Handle(context.Background(), createRequest(t, configMap("other", "singleton"))))
+
+	// A dry run only checks the lock
+	req := createRequest(t, configMap("third", "singleton"))
+	dryRun := true
+	req.DryRun = &dryRun
+	expectAllowed(t, west.Handle(context.Background(), req))
+	if _, held, _ := backend.IsHeld(context.Background(), "ConfigMap/third"); held {
+		t.Error("dry run acquired the lock")
+	}
+}
+
+func TestRenewLocks(t *testing.T) {
+	backend := NewMemoryLockBackend()
+	live := configMap("default", "live")
+	deleting := terminating(configMap("other", "deleting"))
+	w := newTestWebhook(t, []client.Object{live, deleting},
+		WithLockBackend(backend, "east"),
+		WithLockTTL(time.Hour))
+	ctx := context.Background()
+	for _, obj := range []client.Object{live, deleting} {
+		u := toUnstructured(t, obj)
+		key, _ := w.LockKey(ctx, u)
+		if ok, _ := backend.Acquire(ctx, key, w.LockHolder(u), time.Millisecond); !ok {
+			t.Fatal("expected the lock to be acquired")
+		}
+	}
+	time.Sleep(5 * time.Millisecond)
+
+	w.renewLocksOnce(ctx)
+	// The lock of the existing instance is renewed for the configured TTL
+	if holder, held, _ := backend.IsHeld(ctx, "ConfigMap/default"); !held || holder != "east/default/live" {
+		t.Errorf("expected the lock to be renewed, got %q, %v", holder, held)
+	}
+	if lock := backend.locks["ConfigMap/default"]; time.Until(lock.expires) < 59*time.Minute {
+		t.Errorf("expected the lock to be renewed for an hour, expires in %s", time.Until(lock.expires))
+	}
+	// The lock of the instance being deleted is released
+	if _, held, _ := backend.IsHeld(ctx, "ConfigMap/other"); held {
+		t.Error("expected the lock of the terminating instance to be released")
+	}
+	if _, ok := backend.locks["ConfigMap/other"]; ok {
+		t.Error("expected the lock of the terminating instance to be removed")
+	}
+}
@@ -0,0 +1,23 @@
+package highlander
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"sigs.k8s.io/controller-runtime/pkg/metrics"
+)
+
+var cacheFallbackTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "highlander_cache_fallback_total",
+	Help: "Number of times existing instances were listed from the API server " +
+		"because the cache was not available",
+}, []string{"gvk"})
+
+var rbacForbiddenTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "highlander_rbac_forbidden_total",
+	Help: "Number of times listing existing instances was forbidden, which " +
+		"usually means the webhook's RBAC permissions are misconfigured",
+}, []string{"gvk"})
+
+func init() {
+	metrics.Registry.MustRegister(cacheFallbackTotal)
+	metrics.Registry.MustRegister(rbacForbiddenTotal)
+}
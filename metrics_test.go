@@ -0,0 +1,59 @@
+package highlander
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"sigs.k8s.io/controller-runtime/pkg/cache"
+)
+
+func TestCacheFallback(t *testing.T) {
+	notStarted := errorClient{Client: newTestClient(), err: &cache.ErrCacheNotStarted{}}
+	w := newTestWebhookFor(t, &corev1.ConfigMap{}, notStarted)
+
+	// Without an API reader, the error is returned
+	expectErrored(t, w.Handle(context.Background(), createRequest(t, configMap("default", "new"))),
+		http.StatusBadRequest)
+
+	// Otherwise, existing instances are listed from the API server instead
+	w.apiReader = newTestClient(configMap("default", "existing"))
+	fallbacks := cacheFallbackTotal.WithLabelValues(configMapGVK.String())
+	before := testutil.ToFloat64(fallbacks)
+	expectDenied(t, w.Handle(context.Background(), createRequest(t, configMap("default", "new"))))
+	expectAllowed(t, w.Handle(context.Background(), createRequest(t, configMap("other", "new"))))
+	if delta := testutil.ToFloat64(fallbacks) - before; delta != 2 {
+		t.Errorf("expected 2 fallbacks to be counted, got %v", delta)
+	}
+}
+
+func TestRBACForbidden(t *testing.T) {
+	forbidden := apierrors.NewForbidden(schema.GroupResource{Resource: "configmaps"}, "",
+		errors.New("cannot list resource"))
+	w := newTestWebhookFor(t, &corev1.ConfigMap{}, errorClient{Client: newTestClient(), err: forbidden})
+
+	counter := rbacForbiddenTotal.WithLabelValues(configMapGVK.String())
+	before := testutil.ToFloat64(counter)
+	resp := w.Handle(context.Background(), createRequest(t, configMap("default", "new")))
+	expectErrored(t, resp, http.StatusBadRequest)
+	if !strings.Contains(resp.Result.Message, "RBAC permissions may be misconfigured") {
+		t.Errorf("expected the error to mention RBAC, got %q", resp.Result.Message)
+	}
+	if delta := testutil.ToFloat64(counter) - before; delta != 1 {
+		t.Errorf("expected 1 forbidden list to be counted, got %v", delta)
+	}
+
+	// Other errors are not counted
+	w = newTestWebhookFor(t, &corev1.ConfigMap{}, errorClient{Client: newTestClient(), err: errors.New("unavailable")})
+	expectErrored(t, w.Handle(context.Background(), createRequest(t, configMap("default", "new"))),
+		http.StatusBadRequest)
+	if delta := testutil.ToFloat64(counter) - before; delta != 1 {
+		t.Errorf("expected other errors not to be counted, got %v", delta)
+	}
+}
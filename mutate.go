@@ -0,0 +1,209 @@
+package highlander
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	admissionv1 "k8s.io/api/admission/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+)
+
+// AdmittedAtAnnotation is stamped on created objects by the mutating
+// companion webhook when enabled with WithAdmittedAtAnnotation. Its value is
+// the time at which the object was admitted, in RFC3339Nano format.
+const AdmittedAtAnnotation = "highlander.kralicky.dev/admitted-at"
+
+// VerdictAnnotation is stamped on created objects by the mutating companion
+// webhook when enabled with WithVerdictAnnotation. Its value is a JSON-encoded
+// Verdict.
+const VerdictAnnotation = "highlander.kralicky.dev/verdict"
+
+// Verdict describes the response the validating webhook is expected to give
+// for a create.
+type Verdict struct {
+	Allowed  bool     `json:"allowed"`
+	Reason   string   `json:"reason,omitempty"`
+	Warnings []string `json:"warnings,omitempty"`
+}
+
+// CreatorAnnotation is stamped on created objects by the mutating companion
+// webhook when enabled with WithScopeByUser. Its value is the username of the
+// user who created the object.
+const CreatorAnnotation = "highlander.kralicky.dev/created-by"
+
+// DuplicateAnnotation is stamped on created objects by the mutating companion
+// webhook when enabled with WithDuplicateAnnotation. Its value is "true" if
+// the object conflicted with existing instances when it was admitted,
+// "false" otherwise, and "unknown" if the check failed. It is not stamped on
+// objects which the validating webhook does not check, for example while
+// enforcement is paused.
+const DuplicateAnnotation = "highlander.kralicky.dev/duplicate"
+
+// DuplicateOfAnnotation is stamped alongside DuplicateAnnotation on objects
+// which were duplicates. Its value is a comma-separated list of the names of
+// the conflicting instances, if known.
+const DuplicateOfAnnotation = "highlander.kralicky.dev/duplicate-of"
+
+type previewKey struct{}
+
+// isPreview returns whether the request is being handled only to compute
+// its verdict, in which case it must not have any side effects.
+func isPreview(ctx context.Context) bool {
+	return ctx.Value(previewKey{}) != nil
+}
+
+// mutator is the mutating companion to the validating webhook. It is
+// registered on a separate path when any mutating option is enabled.
+type mutator struct {
+	w *Webhook
+}
+
+var _ admission.Handler = (*mutator)(nil)
+
+func (m *mutator) Handle(ctx context.Context, req admission.Request) (resp admission.Response) {
+	defer m.w.recoverPanic(req, &resp)
+
+	if req.Operation != admissionv1.Create {
+		return admission.Allowed("")
+	}
+	// Requests for any served version of the kind are checked. Listing
+	// returns all instances regardless of the version they are stored as.
+	gvk := req.Kind
+	if gvk.Group != m.w.gvk.Group ||
+		gvk.Kind != m.w.gvk.Kind {
+		return admission.Allowed("")
+	}
+
+	obj := &unstructured.Unstructured{}
+	if err := obj.UnmarshalJSON(req.Object.Raw); err != nil {
+		return admission.Errored(http.StatusBadRequest, err)
+	}
+
+	annotations := obj.GetAnnotations()
+	if annotations == nil {
+		annotations = map[string]string{}
+	}
+	if m.w.admittedAtAnnotation {
+		annotations[AdmittedAtAnnotation] = time.Now().UTC().Format(time.RFC3339Nano)
+	}
+	if m.w.scopeByUser {
+		annotations[CreatorAnnotation] = req.UserInfo.Username
+	}
+	if m.w.verdictAnnotation {
+		verdict, err := m.verdict(ctx, req)
+		if err != nil {
+			return admission.Errored(http.StatusInternalServerError, err)
+		}
+		annotations[VerdictAnnotation] = verdict
+	}
+	if m.w.duplicateAnnotation {
+		// Values set by the requester are never kept
+		delete(annotations, DuplicateAnnotation)
+		delete(annotations, DuplicateOfAnnotation)
+	}
+	if m.w.duplicateAnnotation && !m.w.unchecked(req) {
+		// Check the object as it will be created, with the annotations above
+		obj.SetAnnotations(annotations)
+		duplicate, conflicts, err := m.w.duplicates(ctx, obj)
+		switch {
+		case err != nil:
+			// Stamping the annotation is best effort, and must not reject
+			// creates which the validating webhook would allow
+			m.w.log.Error(err, "Failed to check for duplicates",
+				"namespace", obj.GetNamespace(),
+				"name", obj.GetName(),
+			)
+			annotations[DuplicateAnnotation] = "unknown"
+		default:
+			annotations[DuplicateAnnotation] = strconv.FormatBool(duplicate)
+			if duplicate && len(conflicts) > 0 {
+				annotations[DuplicateOfAnnotation] = strings.Join(conflicts, ",")
+			}
+		}
+	}
+	obj.SetAnnotations(annotations)
+
+	marshaled, err := json.Marshal(obj)
+	if err != nil {
+		return admission.Errored(http.StatusInternalServerError, err)
+	}
+	return admission.PatchResponseFromRaw(req.Object.Raw, marshaled)
+}
+
+// verdict runs the validating webhook's handler as a dry run, and returns
+// the JSON-encoded verdict.
+func (m *mutator) verdict(ctx context.Context, req admission.Request) (string, error) {
+	dryRun := true
+	preview := req
+	preview.DryRun = &dryRun
+	resp := m.w.Handle(context.WithValue(ctx, previewKey{}, true), preview)
+
+	verdict := Verdict{
+		Allowed:  resp.Allowed,
+		Warnings: resp.Warnings,
+	}
+	if resp.Result != nil {
+		verdict.Reason = resp.Result.Message
+		if verdict.Reason == "" {
+			verdict.Reason = string(resp.Result.Reason)
+		}
+	}
+	data, err := json.Marshal(verdict)
+	if err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
+
+// duplicates returns whether the object conflicts with existing instances,
+// and the names of the conflicting instances, using a dry run of the
+// uniqueness checks.
+func (w *Webhook) duplicates(
+	ctx context.Context,
+	obj *unstructured.Unstructured,
+) (bool, []string, error) {
+	_, err := w.validateCreate(ctx, obj, validateOptions{
+		reader: w.cli,
+		cached: true,
+		dryRun: true,
+	})
+	var conflict *ConflictError
+	if errors.As(err, &conflict) {
+		return true, conflict.Conflicts, nil
+	}
+	return false, nil, err
+}
+
+// unchecked returns whether creates in the request's namespace are allowed
+// by the validating webhook without checking for existing instances.
+func (w *Webhook) unchecked(req admission.Request) bool {
+	if w.EnforcementMode() == EnforcementOff {
+		return true
+	}
+	if _, ok := w.pausedUntil(req.Namespace); ok {
+		return true
+	}
+	if contains(w.exemptFieldManagers, req.UserInfo.Username) {
+		return true
+	}
+	return w.excludeSystemNamespaces && contains(systemNamespaces, req.Namespace)
+}
+
+// mutating returns whether any option requiring the mutating companion
+// webhook is enabled.
+func (w *Webhook) mutating() bool {
+	return w.admittedAtAnnotation || w.verdictAnnotation || w.scopeByUser ||
+		w.duplicateAnnotation
+}
+
+func generateMutatePath(gvk schema.GroupVersionKind) string {
+	return "/highlander-mutate-" + strings.ReplaceAll(gvk.Group, ".", "-") + "-" +
+		gvk.Version + "-" + strings.ToLower(gvk.Kind)
+}
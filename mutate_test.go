@@ -0,0 +1,248 @@
+package highlander
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	coordinationv1 "k8s.io/api/coordination/v1"
+	corev1 "k8s.io/api/core/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+)
+
+// patchedAnnotations returns the annotations of the object after applying
+// the patches in the response. Only patches to annotations are applied.
+func patchedAnnotations(t *testing.T, obj *corev1.ConfigMap, resp admission.Response) map[string]string {
+	t.Helper()
+	expectAllowed(t, resp)
+	annotations := map[string]string{}
+	for k, v := range obj.Annotations {
+		annotations[k] = v
+	}
+	for _, patch := range resp.Patches {
+		switch {
+		case patch.Path == "/metadata/annotations":
+			annotations = map[string]string{}
+			values, _ := patch.Value.(map[string]interface{})
+			for k, v := range values {
+				annotations[k], _ = v.(string)
+			}
+		case strings.HasPrefix(patch.Path, "/metadata/annotations/"):
+			key := strings.TrimPrefix(patch.Path, "/metadata/annotations/")
+			key = strings.NewReplacer("~1", "/", "~0", "~").Replace(key)
+			if patch.Operation == "remove" {
+				delete(annotations, key)
+			} else {
+				annotations[key], _ = patch.Value.(string)
+			}
+		default:
+			t.Errorf("unexpected patch %s %s", patch.Operation, patch.Path)
+		}
+	}
+	return annotations
+}
+
+func TestAdmittedAtAnnotation(t *testing.T) {
+	w := newTestWebhook(t, nil, WithAdmittedAtAnnotation(true))
+	m := &mutator{w: w}
+
+	annotated := configMap("default", "annotated")
+	annotated.Annotations = map[string]string{"existing": "value"}
+	for _, obj := range []*corev1.ConfigMap{configMap("default", "new"), annotated} {
+		before := time.Now()
+		annotations := patchedAnnotations(t, obj, m.Handle(context.Background(), createRequest(t, obj)))
+		admittedAt, err := time.Parse(time.RFC3339Nano, annotations[AdmittedAtAnnotation])
+		if err != nil {
+			t.Fatalf("invalid admitted-at annotation: %v", err)
+		}
+		if admittedAt.Before(before.Add(-time.Second)) || admittedAt.After(time.Now().Add(time.Second)) {
+			t.Errorf("unexpected admitted-at time %s", admittedAt)
+		}
+		if obj.Annotations != nil && annotations["existing"] != "value" {
+			t.Error("existing annotations were not preserved")
+		}
+	}
+
+	// Updates are not patched
+	obj := configMap("default", "new")
+	resp := m.Handle(context.Background(), updateRequest(t, obj, obj))
+	expectAllowed(t, resp)
+	if len(resp.Patches) != 0 {
+		t.Errorf("expected no patches for an update, got %v", resp.Patches)
+	}
+}
+
+func TestVerdictAnnotation(t *testing.T) {
+	buf := &bytes.Buffer{}
+	existing := []client.Object{
+		configMap("default", "existing"),
+		terminating(configMap("replacing", "old")),
+	}
+	w := newTestWebhook(t, existing,
+		WithVerdictAnnotation(true),
+		WithDecisionLog(buf),
+		WithLease("highlander"))
+	m := &mutator{w: w}
+
+	verdictOf := func(obj *corev1.ConfigMap) Verdict {
+		t.Helper()
+		annotations := patchedAnnotations(t, obj, m.Handle(context.Background(), createRequest(t, obj)))
+		verdict := Verdict{}
+		if err := json.Unmarshal([]byte(annotations[VerdictAnnotation]), &verdict); err != nil {
+			t.Fatalf("invalid verdict annotation: %v", err)
+		}
+		return verdict
+	}
+
+	denied := verdictOf(configMap("default", "new"))
+	if denied.Allowed || denied.Reason != ErrThereCanBeOnlyOne.Error() {
+		t.Errorf("unexpected verdict %+v", denied)
+	}
+	allowed := verdictOf(configMap("other", "new"))
+	if !allowed.Allowed || allowed.Reason != "" {
+		t.Errorf("unexpected verdict %+v", allowed)
+	}
+	warned := verdictOf(configMap("replacing", "new"))
+	if !warned.Allowed || warned.Reason != "" || len(warned.Warnings) != 1 ||
+		warned.Warnings[0] != `allowed because existing instance "old" is terminating` {
+		t.Errorf("unexpected verdict %+v", warned)
+	}
+
+	// Computing the verdict has no side effects
+	if buf.Len() != 0 {
+		t.Errorf("verdict was recorded in the decision log: %s", buf.String())
+	}
+	leases := &coordinationv1.LeaseList{}
+	if err := w.cli.List(context.Background(), leases); err != nil {
+		t.Fatal(err)
+	}
+	if len(leases.Items) != 0 {
+		t.Errorf("verdict acquired %d lease(s)", len(leases.Items))
+	}
+
+	// The verdict matches the response of the validating webhook
+	resp := w.Handle(context.Background(), createRequest(t, configMap("replacing", "new")))
+	expectAllowed(t, resp)
+	if !reflect.DeepEqual(resp.Warnings, warned.Warnings) {
+		t.Errorf("expected warnings %v, got %v", warned.Warnings, resp.Warnings)
+	}
+}
+
+func TestDuplicateAnnotation(t *testing.T) {
+	w := newTestWebhook(t, []client.Object{configMap("default", "existing")},
+		WithDuplicateAnnotation(true))
+	m := &mutator{w: w}
+
+	annotations := patchedAnnotations(t, configMap("other", "new"),
+		m.Handle(context.Background(), createRequest(t, configMap("other", "new"))))
+	if annotations[DuplicateAnnotation] != "false" {
+		t.Errorf("expected the object not to be a duplicate, got %v", annotations)
+	}
+	if _, ok := annotations[DuplicateOfAnnotation]; ok {
+		t.Errorf("unexpected duplicate-of annotation %v", annotations)
+	}
+
+	annotations = patchedAnnotations(t, configMap("default", "new"),
+		m.Handle(context.Background(), createRequest(t, configMap("default", "new"))))
+	if annotations[DuplicateAnnotation] != "true" || annotations[DuplicateOfAnnotation] != "existing" {
+		t.Errorf("expected the object to be a duplicate of existing, got %v", annotations)
+	}
+
+	// Values set by the requester are replaced
+	forged := configMap("default", "new")
+	forged.Annotations = map[string]string{DuplicateAnnotation: "false", DuplicateOfAnnotation: "other"}
+	annotations = patchedAnnotations(t, forged, m.Handle(context.Background(), createRequest(t, forged)))
+	if annotations[DuplicateAnnotation] != "true" || annotations[DuplicateOfAnnotation] != "existing" {
+		t.Errorf("expected the forged annotations to be replaced, got %v", annotations)
+	}
+	forged = configMap("other", "new")
+	forged.Annotations = map[string]string{DuplicateAnnotation: "true", DuplicateOfAnnotation: "existing"}
+	annotations = patchedAnnotations(t, forged, m.Handle(context.Background(), createRequest(t, forged)))
+	if annotations[DuplicateAnnotation] != "false" {
+		t.Errorf("expected the forged annotation to be replaced, got %v", annotations)
+	}
+	if _, ok := annotations[DuplicateOfAnnotation]; ok {
+		t.Errorf("expected the forged duplicate-of annotation to be removed, got %v", annotations)
+	}
+
+	// The validating webhook allows duplicates with a warning
+	resp := w.Handle(context.Background(), createRequest(t, configMap("default", "new")))
+	expectAllowed(t, resp)
+	if len(resp.Warnings) != 1 || !strings.HasPrefix(resp.Warnings[0], "duplicate: ") {
+		t.Errorf("expected a duplicate warning, got %v", resp.Warnings)
+	}
+	// Other checks are still enforced
+	w = newTestWebhook(t, nil, WithDuplicateAnnotation(true), WithNamePattern("^singleton$"))
+	expectDenied(t, w.Handle(context.Background(), createRequest(t, configMap("default", "new"))))
+}
+
+func TestDuplicateAnnotationUnknown(t *testing.T) {
+	w := newTestWebhookFor(t, &corev1.ConfigMap{},
+		errorClient{Client: newTestClient(), err: errors.New("unavailable")},
+		WithDuplicateAnnotation(true))
+	m := &mutator{w: w}
+	annotations := patchedAnnotations(t, configMap("default", "new"),
+		m.Handle(context.Background(), createRequest(t, configMap("default", "new"))))
+	if annotations[DuplicateAnnotation] != "unknown" {
+		t.Errorf("expected the duplicate annotation to be unknown, got %v", annotations)
+	}
+}
+
+func TestDuplicateAnnotationUnchecked(t *testing.T) {
+	existing := []client.Object{
+		configMap("default", "existing"),
+		configMap("kube-system", "existing"),
+	}
+	forged := func(namespace string) *corev1.ConfigMap {
+		obj := configMap(namespace, "new")
+		obj.Annotations = map[string]string{DuplicateAnnotation: "false"}
+		return obj
+	}
+	cases := []struct {
+		name      string
+		w         func(t *testing.T) *Webhook
+		namespace string
+	}{
+		{
+			name: "enforcement off",
+			w: func(t *testing.T) *Webhook {
+				return newTestWebhook(t, existing, WithDuplicateAnnotation(true),
+					WithEnforcementMode(EnforcementOff))
+			},
+			namespace: "default",
+		},
+		{
+			name: "paused",
+			w: func(t *testing.T) *Webhook {
+				w := newTestWebhook(t, existing, WithDuplicateAnnotation(true))
+				w.PauseNamespace("default", time.Now().Add(time.Hour))
+				return w
+			},
+			namespace: "default",
+		},
+		{
+			name: "system namespace",
+			w: func(t *testing.T) *Webhook {
+				return newTestWebhook(t, existing, WithDuplicateAnnotation(true),
+					WithExcludeSystemNamespaces(true))
+			},
+			namespace: "kube-system",
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			m := &mutator{w: c.w(t)}
+			obj := forged(c.namespace)
+			annotations := patchedAnnotations(t, obj, m.Handle(context.Background(), createRequest(t, obj)))
+			if _, ok := annotations[DuplicateAnnotation]; ok {
+				t.Errorf("expected no duplicate annotation, got %v", annotations)
+			}
+		})
+	}
+}
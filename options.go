@@ -0,0 +1,472 @@
+package highlander
+
+import (
+	"strings"
+	"time"
+
+	"golang.org/x/sync/semaphore"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+)
+
+type Option func(*Webhook)
+
+// NamespaceAnnotation is the conventional annotation used with
+// WithScopeAnnotation to record the namespace a cluster-scoped object
+// logically belongs to.
+const NamespaceAnnotation = "highlander.kralicky.dev/namespace"
+
+// WithMiddleware wraps the webhook's handler before it is registered with
+// the webhook server. Middleware is applied in the order given, so the last
+// middleware will be the outermost. This can be combined with Chain to run
+// additional validators on the same path, for example:
+//
+//	WithMiddleware(func(h admission.Handler) admission.Handler {
+//	  return Chain(h, myValidator)
+//	})
+func WithMiddleware(mw ...func(admission.Handler) admission.Handler) Option {
+	return func(w *Webhook) {
+		w.middleware = append(w.middleware, mw...)
+	}
+}
+
+// WithExemptFieldManagers allows creates made by any of the given users
+// without checking for existing instances. This is intended for trusted
+// controllers, identified by their ServiceAccount username (e.g.
+// "system:serviceaccount:my-namespace:my-controller").
+func WithExemptFieldManagers(names ...string) Option {
+	return func(w *Webhook) {
+		w.exemptFieldManagers = append(w.exemptFieldManagers, names...)
+	}
+}
+
+// WithExemptUsers allows the given users to create additional instances,
+// bypassing the restriction. The response will include a warning noting
+// the bypass.
+func WithExemptUsers(usernames ...string) Option {
+	return func(w *Webhook) {
+		w.exemptUsers = append(w.exemptUsers, usernames...)
+	}
+}
+
+// WithExemptGroups allows members of any of the given groups to create
+// additional instances, bypassing the restriction. The response will include
+// a warning noting the bypass.
+func WithExemptGroups(groups ...string) Option {
+	return func(w *Webhook) {
+		w.exemptGroups = append(w.exemptGroups, groups...)
+	}
+}
+
+// WithScopeAnnotation allows one instance of a cluster-scoped object per
+// unique value of the given annotation, instead of one per cluster. Objects
+// without the annotation share a single scope. This option has no effect
+// for namespaced objects.
+func WithScopeAnnotation(key string) Option {
+	return func(w *Webhook) {
+		w.scopeAnnotation = key
+	}
+}
+
+// WithExcludeSystemNamespaces allows creates in the kube-system, kube-public,
+// and kube-node-lease namespaces without checking for existing instances.
+func WithExcludeSystemNamespaces(exclude bool) Option {
+	return func(w *Webhook) {
+		w.excludeSystemNamespaces = exclude
+	}
+}
+
+// WithRequireNamespace denies creates of namespaced objects which do not
+// have a namespace set, instead of checking for existing instances in the
+// empty namespace. This option has no effect for cluster-scoped objects.
+func WithRequireNamespace(require bool) Option {
+	return func(w *Webhook) {
+		w.requireNamespace = require
+	}
+}
+
+// WithMaxConcurrent limits the number of validations which can list
+// existing instances at the same time. Only the list calls are limited, not
+// other work such as acquiring leases or waiting for terminating instances.
+// Additional validations will wait until the admission request times out,
+// and then fail. A value of 0 or less disables the limit.
+func WithMaxConcurrent(n int) Option {
+	return func(w *Webhook) {
+		if n <= 0 {
+			w.maxConcurrent, w.sem = 0, nil
+			return
+		}
+		w.maxConcurrent = n
+		w.sem = semaphore.NewWeighted(int64(n))
+	}
+}
+
+// WithNamePattern denies creates of objects whose name does not match the
+// given regular expression. The pattern is compiled when the webhook is set
+// up, which will fail if the pattern is invalid.
+func WithNamePattern(pattern string) Option {
+	return func(w *Webhook) {
+		w.namePattern = pattern
+	}
+}
+
+// WithEquivalentGVKs counts instances of the given kinds as if they were
+// instances of the webhook's own kind. This is useful while migrating a
+// kind between API groups, when instances of both the old and new kinds may
+// exist. Kinds which are not served by the API server are ignored.
+func WithEquivalentGVKs(gvks ...schema.GroupVersionKind) Option {
+	return func(w *Webhook) {
+		w.equivalentGVKs = append(w.equivalentGVKs, gvks...)
+	}
+}
+
+// WithImmutableIdentity denies updates which would change the scope an
+// object belongs to, such as the value of the annotation configured with
+// WithScopeAnnotation. This keeps the identity of each instance stable.
+// Without this option, such updates are allowed if the new scope has no
+// other instance. The webhook configuration must include UPDATE operations
+// for either check to take effect.
+func WithImmutableIdentity(immutable bool) Option {
+	return func(w *Webhook) {
+		w.immutableIdentity = immutable
+	}
+}
+
+// WithImpersonation lists existing instances as the user making the
+// request, so that only instances visible to that user are counted. Each
+// validation creates a new client which reads directly from the API server
+// instead of the manager's cache, so this has a significant performance
+// cost. This option requires the webhook to be set up with a manager.
+func WithImpersonation(impersonate bool) Option {
+	return func(w *Webhook) {
+		w.impersonate = impersonate
+	}
+}
+
+// WithAdmittedAtAnnotation stamps each created object with the time it was
+// admitted, using the AdmittedAtAnnotation annotation. This can be used to
+// order instances deterministically even when their creation timestamps are
+// equal. Enabling this option registers a mutating companion webhook on a
+// separate path, which must be included in a MutatingWebhookConfiguration.
+func WithAdmittedAtAnnotation(enabled bool) Option {
+	return func(w *Webhook) {
+		w.admittedAtAnnotation = enabled
+	}
+}
+
+// WithVerdictAnnotation stamps each created object with the VerdictAnnotation
+// annotation, describing the response the validating webhook will give. This
+// is a workaround to pass the verdict to webhooks which run later in the
+// admission chain, since admission webhooks cannot otherwise share data.
+// Mutating webhooks run before validating webhooks, so the verdict is computed
+// by the mutating companion webhook using a dry run of the same checks; a
+// later mutating webhook can read the annotation and should remove it. The
+// annotation is left on the object if no other webhook removes it. Enabling
+// this option registers the mutating companion webhook.
+func WithVerdictAnnotation(enabled bool) Option {
+	return func(w *Webhook) {
+		w.verdictAnnotation = enabled
+	}
+}
+
+// WithDuplicateAnnotation makes the webhook informational. Creates which
+// conflict with existing instances are allowed with a warning, and every
+// created object is stamped with the DuplicateAnnotation annotation, plus
+// DuplicateOfAnnotation naming the conflicting instances if it was a
+// duplicate. Duplicates can then be cleaned up by other tooling. Other
+// checks, such as name patterns, are still enforced. Enabling this option
+// registers the mutating companion webhook.
+func WithDuplicateAnnotation(enabled bool) Option {
+	return func(w *Webhook) {
+		w.duplicateAnnotation = enabled
+	}
+}
+
+// WithUniqueLabelValue restricts only objects which have the label key set to
+// the given value, such that there can be only one instance with that label
+// value in each scope. Objects without the label value are not restricted.
+// If the webhook configuration includes UPDATE operations, updates which add
+// the label value to an existing object are also checked.
+func WithUniqueLabelValue(key, value string) Option {
+	return func(w *Webhook) {
+		w.uniqueLabelKey = key
+		w.uniqueLabelValue = value
+	}
+}
+
+// ShardFunc computes the shard an object belongs to.
+type ShardFunc func(obj *unstructured.Unstructured) (string, error)
+
+// WithShardFunc further divides each scope into shards computed from each
+// object, such that there can be one instance per shard in each scope. If
+// the function returns an error for the incoming object, the request fails;
+// existing instances for which it returns an error are not counted.
+func WithShardFunc(fn ShardFunc) Option {
+	return func(w *Webhook) {
+		w.shardFunc = fn
+	}
+}
+
+// WithNamespaceCountAnnotation reads the number of existing instances from
+// the given annotation on the incoming object's namespace, instead of listing
+// objects. The annotation must be maintained by another controller, and its
+// value is trusted as-is, so a stale count can cause creates to be wrongly
+// allowed or denied. If the annotation is missing or is not a valid count,
+// objects are listed as usual. The count covers the whole namespace, so it
+// is only used when no option divides the namespace into smaller scopes or
+// changes which instances are counted, such as WithScopeField,
+// WithUniqueLabelValue or WithPolicy. This option has no effect for
+// cluster-scoped objects. Like WithSkipTerminatingNamespaces, it requires
+// permission to get, list and watch namespaces when set up with a manager.
+func WithNamespaceCountAnnotation(key string) Option {
+	return func(w *Webhook) {
+		w.namespaceCountAnnotation = key
+	}
+}
+
+// WithScopeByUser further divides each scope by the user who created each
+// object, such that each user can create one instance per scope. The creator
+// is recorded in the CreatorAnnotation annotation by the mutating companion
+// webhook, which this option registers and which must be configured for the
+// existing instances to be attributed correctly. Combining this option with
+// WithImmutableIdentity prevents the annotation from being changed later.
+func WithScopeByUser(enabled bool) Option {
+	return func(w *Webhook) {
+		w.scopeByUser = enabled
+	}
+}
+
+// WithNameEqualsScope requires the name of each created object to equal its
+// scope key, which makes the single instance in each scope discoverable by
+// name. The key is the most specific value defining the scope: for example,
+// the namespace by default, or the value of the field set with
+// WithScopeField. Objects in a cluster-wide scope can have any name. This
+// option cannot be combined with WithScopeByUser, WithOwnerChainScope or
+// WithShardFunc, whose scope values are not valid names.
+func WithNameEqualsScope(enabled bool) Option {
+	return func(w *Webhook) {
+		w.nameEqualsScope = enabled
+	}
+}
+
+// WithScopeField further divides each scope by the value of the string field
+// at the given path, such that there can be one instance per field value in
+// each scope. For example, WithScopeField("spec", "nodeName") combined with
+// WithClusterWideScope allows one instance per node in the cluster. Objects
+// without the field share a single scope. Objects sent in another served
+// version are converted to the webhook's version when the scheme can convert
+// between them; otherwise the field must have the same path in every served
+// version. The same applies to WithShardFunc and WithActiveCondition.
+func WithScopeField(fields ...string) Option {
+	return func(w *Webhook) {
+		w.scopeField = fields
+	}
+}
+
+// WithScopeNamespaceField reads the namespace which defines an instance's
+// scope from the string field at the given dot-separated path, such as
+// "spec.targetNamespace", instead of from the object's own namespace. This
+// allows one instance per target namespace when the objects live in a
+// central namespace. Existing instances are listed across all namespaces.
+// Objects without the field are scoped as if this option was not set.
+func WithScopeNamespaceField(jsonPath string) Option {
+	return func(w *Webhook) {
+		w.scopeNamespaceField = strings.Split(strings.TrimPrefix(jsonPath, "."), ".")
+	}
+}
+
+// WithClusterWideScope checks for existing instances of a namespaced object
+// across all namespaces, instead of only in the incoming object's namespace.
+// This is typically combined with WithScopeField.
+func WithClusterWideScope(clusterWide bool) Option {
+	return func(w *Webhook) {
+		w.clusterWide = clusterWide
+	}
+}
+
+// WithSkipTerminatingNamespaces allows creates in namespaces which are being
+// deleted without checking for existing instances, since the API server will
+// reject them anyway. Namespaces are read using the webhook's client. When
+// set up with a manager, that client is backed by the manager's cache, which
+// watches all namespaces, so this requires permission to get, list and watch
+// namespaces. Otherwise, only permission to get namespaces is needed.
+func WithSkipTerminatingNamespaces(skip bool) Option {
+	return func(w *Webhook) {
+		w.skipTerminatingNamespaces = skip
+	}
+}
+
+// WithScheme sets the scheme used to resolve the GVK of the guarded type and
+// to decode requests, instead of the scheme of the manager or the scheme
+// passed to SetupWithServer.
+func WithScheme(scheme *runtime.Scheme) Option {
+	return func(w *Webhook) {
+		w.scheme = scheme
+	}
+}
+
+// WithFixedNamespace denies creates of namespaced objects in any namespace
+// other than the given one, so that there can be only one instance in that
+// namespace and none elsewhere. This option has no effect for cluster-scoped
+// objects.
+func WithFixedNamespace(namespace string) Option {
+	return func(w *Webhook) {
+		w.fixedNamespace = namespace
+	}
+}
+
+// WithActiveCondition only counts existing instances which have a condition
+// of the given type with a status of "True" in status.conditions. This allows
+// a new instance to be created while the existing instance is not active.
+func WithActiveCondition(conditionType string) Option {
+	return func(w *Webhook) {
+		w.activeCondition = conditionType
+	}
+}
+
+// WithCountResource counts objects of the given kind whose names start with
+// the given prefix as existing instances, instead of instances of the
+// webhook's own kind. For example, creates can be denied while a ConfigMap
+// named "foo-lock" exists. This option can be given more than once to count
+// several resources, and replaces WithEquivalentGVKs. Options which define
+// the scope of an instance apply to the counted objects as well.
+func WithCountResource(gvk schema.GroupVersionKind, namePrefix string) Option {
+	return func(w *Webhook) {
+		w.countResources = append(w.countResources, countSource{
+			gvk:        gvk,
+			namePrefix: namePrefix,
+		})
+	}
+}
+
+// WithIgnoreTerminating controls whether existing instances which are being
+// deleted are ignored. By default they are, so that a replacement can be
+// created while the old instance is terminating. If set to false, creates are
+// denied until the old instance is fully deleted.
+func WithIgnoreTerminating(ignore bool) Option {
+	return func(w *Webhook) {
+		w.countTerminating = !ignore
+	}
+}
+
+// WithWaitForTerminating waits for up to the given duration for existing
+// instances which are being deleted to disappear, when they are the only
+// instances in the way of a create. This smooths over replacing an instance
+// by deleting it and immediately creating a new one. The wait is also
+// bounded by the admission request's deadline. This option only has an
+// effect when terminating instances are counted, see WithIgnoreTerminating.
+func WithWaitForTerminating(d time.Duration) Option {
+	return func(w *Webhook) {
+		w.waitForTerminating = d
+	}
+}
+
+// WithRecognizeReplacement allows a create which replaces an existing
+// instance as part of the same apply, rather than being a second instance,
+// even when terminating instances are counted. An object is recognized as a
+// replacement if the existing instance is being deleted, and the
+// kubectl.kubernetes.io/last-applied-configuration annotations of both are
+// identical, ignoring the name. This covers tools which delete and recreate
+// objects with generated names, while the old object is held by finalizers.
+// Instances which are not being deleted are never recognized as replaced,
+// since the annotation is set by the requester and can be copied. Nothing is
+// cleaned up by the webhook; the old instance is removed once its deletion
+// completes.
+func WithRecognizeReplacement(enabled bool) Option {
+	return func(w *Webhook) {
+		w.recognizeReplacement = enabled
+	}
+}
+
+// WithPerValueMax groups instances in each scope by the value of the given
+// label, and allows up to the limit for each value. Values which are not in
+// limits, including objects without the label, are allowed up to
+// defaultLimit instances per value. For example, limits of {prod: 1,
+// staging: 3} on the "env" label allow one production instance and three
+// staging instances per namespace. This option has no effect when policies
+// are configured. It cannot be combined with WithLease or WithLockBackend,
+// which only serialize creates of a single instance per scope.
+func WithPerValueMax(labelKey string, limits map[string]int, defaultLimit int) Option {
+	return func(w *Webhook) {
+		w.perValueKey = labelKey
+		w.perValueLimits = limits
+		w.perValueDefault = defaultLimit
+	}
+}
+
+// WithConfirmOnEmpty controls whether a cached list which finds no existing
+// instances is confirmed by listing from the API server. The cache may not
+// have observed an instance which was created moments earlier, which would
+// let a second instance through. How fresh the cache is cannot be known, so
+// every cached list which returns nothing is confirmed, however recently the
+// cache was synced. The common case of an existing instance stays fast.
+// This option requires the webhook to be set up with a manager.
+func WithConfirmOnEmpty(confirm bool) Option {
+	return func(w *Webhook) {
+		w.confirmOnEmpty = confirm
+	}
+}
+
+// WithListPageSize lists existing instances in pages of the given size,
+// following continue tokens until all instances are found. Listing stops
+// early once a conflicting instance is found, unless all instances are
+// needed to decide, such as when policies are configured. A cache-backed
+// client truncates lists to the page size without a continue token, so if
+// the last page is full, the instances are listed again without a limit.
+// Lists from a metadata informer are not paginated.
+func WithListPageSize(limit int64) Option {
+	return func(w *Webhook) {
+		w.listPageSize = limit
+	}
+}
+
+// DecodeFailurePolicy determines what the webhook does with a request whose
+// object cannot be decoded.
+type DecodeFailurePolicy string
+
+const (
+	// DecodeFailureError rejects the request with a 400 error. This is the
+	// default.
+	DecodeFailureError DecodeFailurePolicy = "error"
+	// DecodeFailureDeny denies the request in the same way as a conflict,
+	// subject to the enforcement mode.
+	DecodeFailureDeny DecodeFailurePolicy = "deny"
+	// DecodeFailureAllow allows the request without checking it.
+	DecodeFailureAllow DecodeFailurePolicy = "allow"
+)
+
+// WithDecodeFailurePolicy sets what the webhook does with a request whose
+// object cannot be decoded.
+func WithDecodeFailurePolicy(policy DecodeFailurePolicy) Option {
+	return func(w *Webhook) {
+		w.decodeFailurePolicy = policy
+	}
+}
+
+// PostListFilter transforms the list of existing instances before they are
+// checked against the incoming object.
+type PostListFilter func(
+	items []unstructured.Unstructured,
+	incoming *unstructured.Unstructured,
+) []unstructured.Unstructured
+
+// WithPostListFilter sets a function which can filter, dedupe, or otherwise
+// modify the existing instances found for each create. The filter runs on
+// the hot path of every validation, so it should be fast and must not make
+// blocking calls.
+func WithPostListFilter(filter PostListFilter) Option {
+	return func(w *Webhook) {
+		w.postListFilter = filter
+	}
+}
+
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,830 @@
+package highlander
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	extensionsv1beta1 "k8s.io/api/extensions/v1beta1"
+	networkingv1 "k8s.io/api/networking/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/webhook"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+)
+
+func TestExemptFieldManagers(t *testing.T) {
+	controller := "system:serviceaccount:default:controller"
+	w := newTestWebhook(t, []client.Object{configMap("default", "existing")},
+		WithExemptFieldManagers(controller))
+
+	req := createRequest(t, configMap("default", "new"))
+	req.UserInfo.Username = controller
+	expectAllowed(t, w.Handle(context.Background(), req))
+
+	req.UserInfo.Username = "alice"
+	expectDenied(t, w.Handle(context.Background(), req))
+}
+
+func TestExemptUsersAndGroups(t *testing.T) {
+	w := newTestWebhook(t, []client.Object{configMap("default", "existing")},
+		WithExemptUsers("admin"),
+		WithExemptGroups("system:masters"))
+
+	req := createRequest(t, configMap("default", "new"))
+	req.UserInfo.Username = "admin"
+	resp := w.Handle(context.Background(), req)
+	expectAllowed(t, resp)
+	if len(resp.Warnings) == 0 {
+		t.Error("expected a warning noting the bypass")
+	}
+
+	req.UserInfo.Username = "bob"
+	req.UserInfo.Groups = []string{"system:authenticated", "system:masters"}
+	expectAllowed(t, w.Handle(context.Background(), req))
+
+	req.UserInfo.Groups = []string{"system:authenticated"}
+	expectDenied(t, w.Handle(context.Background(), req))
+}
+
+func TestExemptUsersDoNotBypassOtherChecks(t *testing.T) {
+	w := newTestWebhook(t, nil,
+		WithExemptUsers("admin"),
+		WithNamePattern("^valid-"))
+
+	req := createRequest(t, configMap("default", "invalid"))
+	req.UserInfo.Username = "admin"
+	expectDenied(t, w.Handle(context.Background(), req))
+}
+
+func persistentVolume(name, namespace string) *corev1.PersistentVolume {
+	pv := &corev1.PersistentVolume{
+		ObjectMeta: metav1.ObjectMeta{Name: name},
+	}
+	if namespace != "" {
+		pv.Annotations = map[string]string{NamespaceAnnotation: namespace}
+	}
+	return pv
+}
+
+func TestScopeAnnotation(t *testing.T) {
+	w := newTestWebhookFor(t, &corev1.PersistentVolume{},
+		newTestClient(persistentVolume("existing", "team-a"), persistentVolume("unscoped", "")),
+		WithScopeAnnotation(NamespaceAnnotation))
+
+	expectDenied(t, w.Handle(context.Background(),
+		createRequest(t, persistentVolume("new", "team-a"))))
+	expectAllowed(t, w.Handle(context.Background(),
+		createRequest(t, persistentVolume("new", "team-b"))))
+	expectDenied(t, w.Handle(context.Background(),
+		createRequest(t, persistentVolume("new", ""))))
+}
+
+func TestExcludeSystemNamespaces(t *testing.T) {
+	existing := []client.Object{configMap("kube-system", "existing"), configMap("default", "existing")}
+
+	w := newTestWebhook(t, existing, WithExcludeSystemNamespaces(true))
+	expectAllowed(t, w.Handle(context.Background(), createRequest(t, configMap("kube-system", "new"))))
+	expectDenied(t, w.Handle(context.Background(), createRequest(t, configMap("default", "new"))))
+
+	w = newTestWebhook(t, existing)
+	expectDenied(t, w.Handle(context.Background(), createRequest(t, configMap("kube-system", "new"))))
+}
+
+func TestRequireNamespace(t *testing.T) {
+	w := newTestWebhook(t, nil, WithRequireNamespace(true))
+	resp := w.Handle(context.Background(), createRequest(t, configMap("", "new")))
+	expectDenied(t, resp)
+	if resp.Result.Reason != metav1.StatusReason(ErrNamespaceRequired.Error()) {
+		t.Errorf("unexpected reason %q", resp.Result.Reason)
+	}
+	expectAllowed(t, w.Handle(context.Background(), createRequest(t, configMap("default", "new"))))
+
+	// Cluster-scoped objects never have a namespace
+	pvs := newTestWebhookFor(t, &corev1.PersistentVolume{}, newTestClient(), WithRequireNamespace(true))
+	expectAllowed(t, pvs.Handle(context.Background(), createRequest(t, persistentVolume("new", ""))))
+}
+
+func TestNamePattern(t *testing.T) {
+	w := newTestWebhook(t, nil, WithNamePattern("^cluster-config$"))
+	expectAllowed(t, w.Handle(context.Background(), createRequest(t, configMap("default", "cluster-config"))))
+	resp := w.Handle(context.Background(), createRequest(t, configMap("default", "other")))
+	expectDenied(t, resp)
+	if !strings.Contains(string(resp.Result.Reason), "^cluster-config$") {
+		t.Errorf("expected the reason to include the pattern, got %q", resp.Result.Reason)
+	}
+}
+
+// noMatchClient is a client which does not serve the given kind.
+type noMatchClient struct {
+	client.Client
+	gvk schema.GroupVersionKind
+}
+
+func (c noMatchClient) List(ctx context.Context, list client.ObjectList, opts ...client.ListOption) error {
+	if gvk := list.GetObjectKind().GroupVersionKind(); gvk.GroupKind() == c.gvk.GroupKind() {
+		return &meta.NoKindMatchError{GroupKind: gvk.GroupKind(), SearchedVersions: []string{gvk.Version}}
+	}
+	return c.Client.List(ctx, list, opts...)
+}
+
+func TestEquivalentGVKs(t *testing.T) {
+	oldGVK := extensionsv1beta1.SchemeGroupVersion.WithKind("Ingress")
+	old := &extensionsv1beta1.Ingress{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "old"},
+	}
+	newIngress := func(namespace, name string) *networkingv1.Ingress {
+		return &networkingv1.Ingress{
+			ObjectMeta: metav1.ObjectMeta{Namespace: namespace, Name: name},
+		}
+	}
+
+	w := newTestWebhookFor(t, &networkingv1.Ingress{},
+		newTestClient(old, newIngress("other", "existing")),
+		WithEquivalentGVKs(oldGVK))
+	expectDenied(t, w.Handle(context.Background(), createRequest(t, newIngress("default", "new"))))
+	expectDenied(t, w.Handle(context.Background(), createRequest(t, newIngress("other", "new"))))
+	expectAllowed(t, w.Handle(context.Background(), createRequest(t, newIngress("third", "new"))))
+
+	// Instances of the old group are not counted without the option
+	w = newTestWebhookFor(t, &networkingv1.Ingress{}, newTestClient(old))
+	expectAllowed(t, w.Handle(context.Background(), createRequest(t, newIngress("default", "new"))))
+
+	// Equivalent kinds which are no longer served are ignored
+	w = newTestWebhookFor(t, &networkingv1.Ingress{},
+		noMatchClient{Client: newTestClient(old), gvk: oldGVK},
+		WithEquivalentGVKs(oldGVK))
+	expectAllowed(t, w.Handle(context.Background(), createRequest(t, newIngress("default", "new"))))
+}
+
+func TestPostListFilter(t *testing.T) {
+	existing := []client.Object{
+		configMap("default", "a"),
+		configMap("default", "b"),
+		configMap("other", "c"),
+		configMap("other", "d"),
+	}
+	var listed int
+	// Drop every other instance, in this case "b" and "d"
+	everyOther := func(items []unstructured.Unstructured, _ *unstructured.Unstructured) []unstructured.Unstructured {
+		listed += len(items)
+		var kept []unstructured.Unstructured
+		for i, item := range items {
+			if i%2 == 0 {
+				kept = append(kept, item)
+			}
+		}
+		return kept
+	}
+	w := newTestWebhook(t, existing, WithPostListFilter(everyOther))
+
+	// Each namespace keeps one of its two instances
+	expectDenied(t, w.Handle(context.Background(), createRequest(t, configMap("default", "new"))))
+	if listed != 2 {
+		t.Errorf("expected the filter to see both instances in the namespace, saw %d", listed)
+	}
+
+	// Drop everything, so that no instance conflicts
+	dropAll := func([]unstructured.Unstructured, *unstructured.Unstructured) []unstructured.Unstructured {
+		return nil
+	}
+	w = newTestWebhook(t, existing, WithPostListFilter(dropAll))
+	expectAllowed(t, w.Handle(context.Background(), createRequest(t, configMap("default", "new"))))
+}
+
+func labeledConfigMap(namespace, name string, labels map[string]string) *corev1.ConfigMap {
+	cm := configMap(namespace, name)
+	cm.Labels = labels
+	return cm
+}
+
+func TestUniqueLabelValue(t *testing.T) {
+	leader := map[string]string{"role": "leader"}
+	follower := map[string]string{"role": "follower"}
+	existingLeader := labeledConfigMap("default", "leader", leader)
+	existingFollower := labeledConfigMap("default", "replica-1", follower)
+	w := newTestWebhook(t, []client.Object{existingLeader, existingFollower},
+		WithUniqueLabelValue("role", "leader"))
+
+	// Any number of replicas without the label value are allowed
+	expectAllowed(t, w.Handle(context.Background(),
+		createRequest(t, labeledConfigMap("default", "replica-2", follower))))
+	expectAllowed(t, w.Handle(context.Background(),
+		createRequest(t, configMap("default", "unlabeled"))))
+	// A second leader is denied
+	expectDenied(t, w.Handle(context.Background(),
+		createRequest(t, labeledConfigMap("default", "leader-2", leader))))
+	expectAllowed(t, w.Handle(context.Background(),
+		createRequest(t, labeledConfigMap("other", "leader", leader))))
+	// Promoting a replica to leader is denied
+	expectDenied(t, w.Handle(context.Background(),
+		updateRequest(t, existingFollower, labeledConfigMap("default", "replica-1", leader))))
+}
+
+func TestShardFunc(t *testing.T) {
+	byRegion := func(obj *unstructured.Unstructured) (string, error) {
+		region, _, _ := unstructured.NestedString(obj.Object, "data", "region")
+		if region == "" {
+			return "", errors.New("region is required")
+		}
+		return region, nil
+	}
+	regional := func(namespace, name, region string) *corev1.ConfigMap {
+		cm := configMap(namespace, name)
+		cm.Data = map[string]string{"region": region}
+		return cm
+	}
+	w := newTestWebhook(t, []client.Object{
+		regional("default", "east", "us-east"),
+		// Existing instances without a shard are not counted
+		configMap("default", "unsharded"),
+	}, WithShardFunc(byRegion))
+
+	expectDenied(t, w.Handle(context.Background(), createRequest(t, regional("default", "new", "us-east"))))
+	expectAllowed(t, w.Handle(context.Background(), createRequest(t, regional("default", "new", "us-west"))))
+	expectAllowed(t, w.Handle(context.Background(), createRequest(t, regional("other", "new", "us-east"))))
+	expectErrored(t, w.Handle(context.Background(), createRequest(t, configMap("other", "new"))),
+		http.StatusBadRequest)
+}
+
+func namespaceWithCount(name, count string) *corev1.Namespace {
+	ns := &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: name}}
+	if count != "" {
+		ns.Annotations = map[string]string{"example.com/count": count}
+	}
+	return ns
+}
+
+func TestNamespaceCountAnnotation(t *testing.T) {
+	objs := []client.Object{
+		namespaceWithCount("occupied", "1"),
+		namespaceWithCount("empty", "0"),
+		namespaceWithCount("unannotated", ""),
+		namespaceWithCount("invalid", "many"),
+		configMap("unannotated", "existing"),
+		configMap("invalid", "existing"),
+	}
+	// Lists fail, so any create which is decided by listing is rejected
+	noList := errorClient{Client: newTestClient(objs...), err: errors.New("listed")}
+	w := newTestWebhookFor(t, &corev1.ConfigMap{}, noList,
+		WithNamespaceCountAnnotation("example.com/count"))
+
+	expectDenied(t, w.Handle(context.Background(), createRequest(t, configMap("occupied", "new"))))
+	expectAllowed(t, w.Handle(context.Background(), createRequest(t, configMap("empty", "new"))))
+	expectErrored(t, w.Handle(context.Background(), createRequest(t, configMap("unannotated", "new"))),
+		http.StatusBadRequest)
+	expectErrored(t, w.Handle(context.Background(), createRequest(t, configMap("invalid", "new"))),
+		http.StatusBadRequest)
+
+	// Missing or invalid counts fall back to listing
+	w = newTestWebhook(t, objs, WithNamespaceCountAnnotation("example.com/count"))
+	expectDenied(t, w.Handle(context.Background(), createRequest(t, configMap("unannotated", "new"))))
+	expectDenied(t, w.Handle(context.Background(), createRequest(t, configMap("invalid", "new"))))
+
+	// The count is not used with options which divide the namespace
+	w = newTestWebhookFor(t, &corev1.ConfigMap{}, noList,
+		WithNamespaceCountAnnotation("example.com/count"),
+		WithScopeField("data", "zone"))
+	expectErrored(t, w.Handle(context.Background(), createRequest(t, configMap("occupied", "new"))),
+		http.StatusBadRequest)
+}
+
+func TestOnePerNode(t *testing.T) {
+	pod := func(namespace, name, node string) *corev1.Pod {
+		return &corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{Namespace: namespace, Name: name},
+			Spec:       corev1.PodSpec{NodeName: node},
+		}
+	}
+	w := newTestWebhookFor(t, &corev1.Pod{}, newTestClient(pod("a", "agent", "node-1")),
+		WithClusterWideScope(true),
+		WithScopeField("spec", "nodeName"))
+
+	expectAllowed(t, w.Handle(context.Background(), createRequest(t, pod("a", "agent-2", "node-2"))))
+	// Instances on the same node conflict across namespaces
+	expectDenied(t, w.Handle(context.Background(), createRequest(t, pod("b", "agent-2", "node-1"))))
+}
+
+func TestSkipTerminatingNamespaces(t *testing.T) {
+	deleting := terminating(&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "deleting"}})
+	phase := &corev1.Namespace{
+		ObjectMeta: metav1.ObjectMeta{Name: "phase"},
+		Status:     corev1.NamespaceStatus{Phase: corev1.NamespaceTerminating},
+	}
+	active := &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "active"}}
+	// Lists fail, so only creates which are not checked are allowed
+	noList := errorClient{Client: newTestClient(deleting, phase, active), err: errors.New("listed")}
+	w := newTestWebhookFor(t, &corev1.ConfigMap{}, noList, WithSkipTerminatingNamespaces(true))
+
+	expectAllowed(t, w.Handle(context.Background(), createRequest(t, configMap("deleting", "new"))))
+	expectAllowed(t, w.Handle(context.Background(), createRequest(t, configMap("phase", "new"))))
+	expectErrored(t, w.Handle(context.Background(), createRequest(t, configMap("active", "new"))),
+		http.StatusBadRequest)
+	// Namespaces which cannot be read are checked as usual
+	expectErrored(t, w.Handle(context.Background(), createRequest(t, configMap("missing", "new"))),
+		http.StatusBadRequest)
+}
+
+func TestScheme(t *testing.T) {
+	// A purpose-built scheme containing only the guarded type
+	scheme := runtime.NewScheme()
+	scheme.AddKnownTypes(corev1.SchemeGroupVersion, &corev1.ConfigMap{}, &corev1.ConfigMapList{})
+	empty := runtime.NewScheme()
+	c := newTestClient(configMap("default", "existing"))
+
+	if err := NewFor(&corev1.ConfigMap{}).SetupWithServer(&webhook.Server{}, empty, c); err == nil {
+		t.Fatal("expected setup to fail with a scheme which does not contain the type")
+	}
+
+	w := NewFor(&corev1.ConfigMap{}, WithScheme(scheme))
+	if err := w.SetupWithServer(&webhook.Server{}, empty, c); err != nil {
+		t.Fatal(err)
+	}
+	if w.gvk != configMapGVK || !w.EffectiveConfig().CustomScheme {
+		t.Errorf("expected the custom scheme to be used, got %s", w.gvk)
+	}
+	expectDenied(t, w.Handle(context.Background(), createRequest(t, configMap("default", "new"))))
+}
+
+func TestFixedNamespace(t *testing.T) {
+	w := newTestWebhook(t, []client.Object{configMap("other", "existing")},
+		WithFixedNamespace("operator"))
+
+	expectAllowed(t, w.Handle(context.Background(), createRequest(t, configMap("operator", "singleton"))))
+	resp := w.Handle(context.Background(), createRequest(t, configMap("other", "singleton")))
+	expectDenied(t, resp)
+	if reason := string(resp.Result.Reason); reason != `this object can only be created in the "operator" namespace` {
+		t.Errorf("unexpected reason %q", reason)
+	}
+
+	w = newTestWebhook(t, []client.Object{configMap("operator", "existing")},
+		WithFixedNamespace("operator"))
+	expectDenied(t, w.Handle(context.Background(), createRequest(t, configMap("operator", "singleton"))))
+}
+
+func TestActiveCondition(t *testing.T) {
+	pod := func(namespace, name string, ready corev1.ConditionStatus) *corev1.Pod {
+		return &corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{Namespace: namespace, Name: name},
+			Status: corev1.PodStatus{
+				Conditions: []corev1.PodCondition{{Type: corev1.PodReady, Status: ready}},
+			},
+		}
+	}
+	w := newTestWebhookFor(t, &corev1.Pod{},
+		newTestClient(pod("active", "existing", corev1.ConditionTrue), pod("inactive", "existing", corev1.ConditionFalse)),
+		WithActiveCondition(string(corev1.PodReady)))
+
+	expectDenied(t, w.Handle(context.Background(), createRequest(t, pod("active", "new", ""))))
+	// Instances without the condition set to True can be replaced
+	expectAllowed(t, w.Handle(context.Background(), createRequest(t, pod("inactive", "new", ""))))
+}
+
+func TestScopeByUser(t *testing.T) {
+	existing := configMap("default", "existing")
+	existing.Annotations = map[string]string{CreatorAnnotation: "alice"}
+	w := newTestWebhook(t, []client.Object{existing}, WithScopeByUser(true))
+
+	req := createRequest(t, configMap("default", "new"))
+	req.UserInfo.Username = "alice"
+	expectDenied(t, w.Handle(context.Background(), req))
+	req.UserInfo.Username = "bob"
+	expectAllowed(t, w.Handle(context.Background(), req))
+
+	// The creator cannot be forged by the requester
+	forged := configMap("default", "new")
+	forged.Annotations = map[string]string{CreatorAnnotation: "bob"}
+	req = createRequest(t, forged)
+	req.UserInfo.Username = "alice"
+	expectDenied(t, w.Handle(context.Background(), req))
+	annotations := patchedAnnotations(t, forged, (&mutator{w: w}).Handle(context.Background(), req))
+	if annotations[CreatorAnnotation] != "alice" {
+		t.Errorf("expected the mutating webhook to stamp the creator, got %q", annotations[CreatorAnnotation])
+	}
+}
+
+func TestCountResource(t *testing.T) {
+	secret := func(namespace, name string) *corev1.Secret {
+		return &corev1.Secret{ObjectMeta: metav1.ObjectMeta{Namespace: namespace, Name: name}}
+	}
+	w := newTestWebhookFor(t, &corev1.Secret{}, newTestClient(
+		configMap("locked", "lock-1"),
+		configMap("unlocked", "other"),
+		secret("secrets", "existing"),
+	), WithCountResource(configMapGVK, "lock-"))
+
+	expectDenied(t, w.Handle(context.Background(), createRequest(t, secret("locked", "new"))))
+	// Only objects with the prefix are counted
+	expectAllowed(t, w.Handle(context.Background(), createRequest(t, secret("unlocked", "new"))))
+	// Instances of the webhook's own kind are no longer counted
+	expectAllowed(t, w.Handle(context.Background(), createRequest(t, secret("secrets", "new"))))
+}
+
+func TestIgnoreTerminating(t *testing.T) {
+	existing := []client.Object{terminating(configMap("default", "old"))}
+
+	w := newTestWebhook(t, existing, WithIgnoreTerminating(true))
+	expectAllowed(t, w.Handle(context.Background(), createRequest(t, configMap("default", "new"))))
+
+	w = newTestWebhook(t, existing, WithIgnoreTerminating(false))
+	expectDenied(t, w.Handle(context.Background(), createRequest(t, configMap("default", "new"))))
+}
+
+func TestPerValueMax(t *testing.T) {
+	prod := map[string]string{"tier": "prod"}
+	dev := map[string]string{"tier": "dev"}
+	w := newTestWebhook(t, []client.Object{
+		labeledConfigMap("default", "prod-1", prod),
+		labeledConfigMap("default", "dev-1", dev),
+		labeledConfigMap("default", "dev-2", dev),
+		configMap("default", "unlabeled"),
+		labeledConfigMap("default", "qa-1", map[string]string{"tier": "qa"}),
+		labeledConfigMap("default", "qa-2", map[string]string{"tier": "qa"}),
+	}, WithPerValueMax("tier", map[string]int{"prod": 1, "dev": 3}, 2))
+
+	resp := w.Handle(context.Background(), createRequest(t, labeledConfigMap("default", "prod-2", prod)))
+	expectDenied(t, resp)
+	if reason := string(resp.Result.Reason); reason != "instance limit exceeded: at most 1 instance(s) with label tier=prod are allowed per scope" {
+		t.Errorf("unexpected reason %q", reason)
+	}
+	expectAllowed(t, w.Handle(context.Background(), createRequest(t, labeledConfigMap("default", "dev-3", dev))))
+	// Other values, and objects without the label, get the default limit
+	expectAllowed(t, w.Handle(context.Background(), createRequest(t, configMap("default", "unlabeled-2"))))
+	expectAllowed(t, w.Handle(context.Background(),
+		createRequest(t, labeledConfigMap("default", "test-1", map[string]string{"tier": "test"}))))
+	expectDenied(t, w.Handle(context.Background(),
+		createRequest(t, labeledConfigMap("default", "qa-3", map[string]string{"tier": "qa"}))))
+}
+
+func TestPerValueMaxCombinations(t *testing.T) {
+	for name, opt := range map[string]Option{
+		"lease":        WithLease("default"),
+		"lock backend": WithLockBackend(NewMemoryLockBackend(), "east"),
+	} {
+		t.Run(name, func(t *testing.T) {
+			w := NewFor(&corev1.ConfigMap{}, WithPerValueMax("tier", nil, 1), opt)
+			err := w.SetupWithServer(&webhook.Server{}, testScheme, newTestClient())
+			if err == nil || err.Error() != "WithPerValueMax cannot be combined with WithLease or WithLockBackend" {
+				t.Errorf("expected the combination to be rejected, got %v", err)
+			}
+		})
+	}
+}
+
+func TestConfirmOnEmpty(t *testing.T) {
+	// The cache has not observed the instance which exists in the API server
+	live := newTestClient(configMap("default", "existing"))
+
+	w := newTestWebhook(t, nil)
+	w.apiReader = live
+	expectAllowed(t, w.Handle(context.Background(), createRequest(t, configMap("default", "new"))))
+
+	w = newTestWebhook(t, nil, WithConfirmOnEmpty(true))
+	w.apiReader = live
+	expectDenied(t, w.Handle(context.Background(), createRequest(t, configMap("default", "new"))))
+	expectAllowed(t, w.Handle(context.Background(), createRequest(t, configMap("other", "new"))))
+
+	// Clients whose type cannot be compared are supported
+	w = newTestWebhookFor(t, &corev1.ConfigMap{}, uncomparableClient{Client: newTestClient()},
+		WithConfirmOnEmpty(true))
+	w.apiReader = live
+	expectDenied(t, w.Handle(context.Background(), createRequest(t, configMap("default", "new"))))
+}
+
+// uncomparableClient is a client whose values cannot be compared with ==.
+type uncomparableClient struct {
+	client.Client
+	_ []string
+}
+
+// removeFinalizers removes the finalizers of a terminating object, which
+// deletes it.
+func removeFinalizers(c client.Client, obj client.Object) error {
+	ctx := context.Background()
+	if err := c.Get(ctx, client.ObjectKeyFromObject(obj), obj); err != nil {
+		return err
+	}
+	obj.SetFinalizers(nil)
+	return c.Update(ctx, obj)
+}
+
+func TestWaitForTerminating(t *testing.T) {
+	old := terminating(configMap("default", "old"))
+
+	// The terminating instance is deleted while the create waits
+	c := newTestClient(old)
+	w := newTestWebhookFor(t, &corev1.ConfigMap{}, c,
+		WithIgnoreTerminating(false),
+		WithWaitForTerminating(5*time.Second))
+	deleted := make(chan error, 1)
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		deleted <- removeFinalizers(c, configMap("default", "old"))
+	}()
+	expectAllowed(t, w.Handle(context.Background(), createRequest(t, configMap("default", "new"))))
+	if err := <-deleted; err != nil {
+		t.Fatal(err)
+	}
+
+	// The terminating instance is still present after the wait
+	w = newTestWebhook(t, []client.Object{terminating(configMap("default", "old"))},
+		WithIgnoreTerminating(false),
+		WithWaitForTerminating(50*time.Millisecond))
+	expectDenied(t, w.Handle(context.Background(), createRequest(t, configMap("default", "new"))))
+
+	// Creates are not delayed by instances which are not terminating
+	w = newTestWebhook(t, []client.Object{
+		terminating(configMap("default", "old")),
+		configMap("default", "live"),
+	}, WithIgnoreTerminating(false), WithWaitForTerminating(time.Hour))
+	start := time.Now()
+	expectDenied(t, w.Handle(context.Background(), createRequest(t, configMap("default", "new"))))
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("expected the create to be denied without waiting, took %s", elapsed)
+	}
+
+	// The wait is bounded by the request's deadline
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	w = newTestWebhook(t, []client.Object{terminating(configMap("default", "old"))},
+		WithIgnoreTerminating(false),
+		WithWaitForTerminating(time.Hour))
+	start = time.Now()
+	expectDenied(t, w.Handle(ctx, createRequest(t, configMap("default", "new"))))
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("expected the wait to end at the request's deadline, took %s", elapsed)
+	}
+}
+
+func TestDecodeFailurePolicy(t *testing.T) {
+	malformed := func(t *testing.T) admission.Request {
+		req := createRequest(t, configMap("default", "new"))
+		req.Object.Raw = []byte(`{"metadata": `)
+		return req
+	}
+
+	w := newTestWebhook(t, nil)
+	expectErrored(t, w.Handle(context.Background(), malformed(t)), http.StatusBadRequest)
+	w = newTestWebhook(t, nil, WithDecodeFailurePolicy(DecodeFailureError))
+	expectErrored(t, w.Handle(context.Background(), malformed(t)), http.StatusBadRequest)
+
+	w = newTestWebhook(t, nil, WithDecodeFailurePolicy(DecodeFailureDeny))
+	resp := w.Handle(context.Background(), malformed(t))
+	expectDenied(t, resp)
+	if !strings.HasPrefix(string(resp.Result.Reason), "failed to decode object: ") {
+		t.Errorf("unexpected reason %q", resp.Result.Reason)
+	}
+
+	w = newTestWebhook(t, []client.Object{configMap("default", "existing")},
+		WithDecodeFailurePolicy(DecodeFailureAllow))
+	resp = w.Handle(context.Background(), malformed(t))
+	expectAllowed(t, resp)
+	if len(resp.Warnings) != 1 || !strings.HasPrefix(resp.Warnings[0], "allowed without checking for other instances: ") {
+		t.Errorf("unexpected warnings %v", resp.Warnings)
+	}
+	// Objects which can be decoded are still checked
+	expectDenied(t, w.Handle(context.Background(), createRequest(t, configMap("default", "new"))))
+}
+
+// pagingClient serves lists in pages, like the API server, and records the
+// limit and continue token of each list call. If truncate is true, it
+// instead truncates lists to the limit without returning a continue token,
+// like the manager's cache.
+type pagingClient struct {
+	client.Client
+	truncate bool
+	calls    []client.ListOptions
+}
+
+func (c *pagingClient) List(ctx context.Context, list client.ObjectList, opts ...client.ListOption) error {
+	listOpts := client.ListOptions{}
+	listOpts.ApplyOptions(opts)
+	c.calls = append(c.calls, client.ListOptions{Limit: listOpts.Limit, Continue: listOpts.Continue})
+	if err := c.Client.List(ctx, list, client.InNamespace(listOpts.Namespace)); err != nil {
+		return err
+	}
+	ul := list.(*unstructured.UnstructuredList)
+	sort.Slice(ul.Items, func(i, j int) bool {
+		return ul.Items[i].GetName() < ul.Items[j].GetName()
+	})
+	start := 0
+	if listOpts.Continue != "" {
+		start, _ = strconv.Atoi(listOpts.Continue)
+	}
+	ul.Items = ul.Items[start:]
+	if listOpts.Limit > 0 && int64(len(ul.Items)) > listOpts.Limit {
+		ul.Items = ul.Items[:listOpts.Limit]
+		if !c.truncate {
+			ul.SetContinue(strconv.Itoa(start + int(listOpts.Limit)))
+		}
+	}
+	return nil
+}
+
+func TestListPageSize(t *testing.T) {
+	leader := map[string]string{"role": "leader"}
+	followers := []client.Object{
+		configMap("default", "b1"),
+		configMap("default", "b2"),
+		configMap("default", "b3"),
+		configMap("default", "b4"),
+		configMap("default", "b5"),
+	}
+	newWebhook := func(c client.Client) *Webhook {
+		return newTestWebhookFor(t, &corev1.ConfigMap{}, c,
+			WithUniqueLabelValue("role", "leader"),
+			WithListPageSize(2))
+	}
+	expectCalls := func(t *testing.T, c *pagingClient, expected ...client.ListOptions) {
+		t.Helper()
+		if !reflect.DeepEqual(c.calls, expected) {
+			t.Errorf("expected list calls %+v, got %+v", expected, c.calls)
+		}
+	}
+
+	// All pages are listed when there is no conflict
+	c := &pagingClient{Client: newTestClient(followers...)}
+	w := newWebhook(c)
+	expectAllowed(t, w.Handle(context.Background(), createRequest(t, labeledConfigMap("default", "new", leader))))
+	expectCalls(t, c,
+		client.ListOptions{Limit: 2},
+		client.ListOptions{Limit: 2, Continue: "2"},
+		client.ListOptions{Limit: 2, Continue: "4"})
+
+	// Listing stops at the first page with a conflict
+	c = &pagingClient{Client: newTestClient(append(followers, labeledConfigMap("default", "a", leader))...)}
+	w = newWebhook(c)
+	expectDenied(t, w.Handle(context.Background(), createRequest(t, labeledConfigMap("default", "new", leader))))
+	expectCalls(t, c, client.ListOptions{Limit: 2})
+
+	// A conflict on the last page is found
+	c = &pagingClient{Client: newTestClient(append(followers, labeledConfigMap("default", "c", leader))...)}
+	w = newWebhook(c)
+	expectDenied(t, w.Handle(context.Background(), createRequest(t, labeledConfigMap("default", "new", leader))))
+	expectCalls(t, c,
+		client.ListOptions{Limit: 2},
+		client.ListOptions{Limit: 2, Continue: "2"},
+		client.ListOptions{Limit: 2, Continue: "4"})
+}
+
+func TestListPageSizeTruncated(t *testing.T) {
+	leader := map[string]string{"role": "leader"}
+	objs := []client.Object{
+		configMap("default", "b1"),
+		configMap("default", "b2"),
+		configMap("default", "b3"),
+		labeledConfigMap("default", "c", leader),
+	}
+
+	// A truncated list is listed again without a limit
+	c := &pagingClient{Client: newTestClient(objs...), truncate: true}
+	w := newTestWebhookFor(t, &corev1.ConfigMap{}, c,
+		WithUniqueLabelValue("role", "leader"),
+		WithListPageSize(2))
+	expectDenied(t, w.Handle(context.Background(), createRequest(t, labeledConfigMap("default", "new", leader))))
+	if len(c.calls) != 2 || c.calls[0].Limit != 2 || c.calls[1].Limit != 0 {
+		t.Errorf("expected a limited list followed by a full list, got %+v", c.calls)
+	}
+
+	// A list shorter than the limit is complete
+	c = &pagingClient{Client: newTestClient(objs[:3]...), truncate: true}
+	w = newTestWebhookFor(t, &corev1.ConfigMap{}, c,
+		WithUniqueLabelValue("role", "leader"),
+		WithListPageSize(10))
+	expectAllowed(t, w.Handle(context.Background(), createRequest(t, labeledConfigMap("default", "new", leader))))
+	if len(c.calls) != 1 {
+		t.Errorf("expected a single list, got %+v", c.calls)
+	}
+}
+
+func targetConfigMap(namespace, name, target string) *corev1.ConfigMap {
+	cm := configMap(namespace, name)
+	cm.Data = map[string]string{"target": target}
+	return cm
+}
+
+func TestScopeNamespaceField(t *testing.T) {
+	w := newTestWebhook(t, []client.Object{
+		targetConfigMap("central", "a", "team-a"),
+		configMap("team-c", "c"),
+	}, WithScopeNamespaceField(".data.target"))
+
+	expectDenied(t, w.Handle(context.Background(), createRequest(t, targetConfigMap("central", "new", "team-a"))))
+	expectAllowed(t, w.Handle(context.Background(), createRequest(t, targetConfigMap("central", "new", "team-b"))))
+	// Instances are listed across all namespaces
+	expectDenied(t, w.Handle(context.Background(), createRequest(t, targetConfigMap("other", "new", "team-a"))))
+	// Objects without the field are scoped by their own namespace
+	expectDenied(t, w.Handle(context.Background(), createRequest(t, configMap("team-a", "new"))))
+	expectDenied(t, w.Handle(context.Background(), createRequest(t, targetConfigMap("central", "new", "team-c"))))
+	expectAllowed(t, w.Handle(context.Background(), createRequest(t, configMap("central", "new"))))
+
+	opts, err := w.ComputeListOptions(toUnstructured(t, targetConfigMap("central", "new", "team-a")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if opts.Namespace != "" {
+		t.Errorf("expected instances to be listed across all namespaces, got %q", opts.Namespace)
+	}
+}
+
+func TestNameEqualsScope(t *testing.T) {
+	w := newTestWebhook(t, nil, WithNameEqualsScope(true))
+	expectAllowed(t, w.Handle(context.Background(), createRequest(t, configMap("team-a", "team-a"))))
+	resp := w.Handle(context.Background(), createRequest(t, configMap("team-a", "config")))
+	expectDenied(t, resp)
+	if reason := string(resp.Result.Reason); reason != `name "config" must be "team-a" to match the scope of this object` {
+		t.Errorf("unexpected reason %q", reason)
+	}
+
+	// The most specific part of the scope is used
+	w = newTestWebhook(t, nil, WithNameEqualsScope(true), WithScopeField("data", "zone"))
+	expectAllowed(t, w.Handle(context.Background(), createRequest(t, zoneConfigMap("default", "east", "east"))))
+	expectDenied(t, w.Handle(context.Background(), createRequest(t, zoneConfigMap("default", "default", "east"))))
+
+	// Values containing a slash are not split
+	resp = w.Handle(context.Background(), createRequest(t, zoneConfigMap("default", "b", "a/b")))
+	expectDenied(t, resp)
+	if reason := string(resp.Result.Reason); reason != `name "b" must be "a/b" to match the scope of this object` {
+		t.Errorf("unexpected reason %q", reason)
+	}
+
+	// The scope annotation of cluster-scoped objects is used
+	w = newTestWebhookFor(t, &corev1.PersistentVolume{}, newTestClient(),
+		WithScopeAnnotation(NamespaceAnnotation),
+		WithNameEqualsScope(true))
+	expectAllowed(t, w.Handle(context.Background(), createRequest(t, persistentVolume("team-a", "team-a"))))
+	expectDenied(t, w.Handle(context.Background(), createRequest(t, persistentVolume("volume", "team-a"))))
+
+	// Objects in a cluster-wide scope can have any name
+	w = newTestWebhook(t, nil, WithNameEqualsScope(true), WithClusterWideScope(true))
+	expectAllowed(t, w.Handle(context.Background(), createRequest(t, configMap("default", "config"))))
+
+	// Updates are not checked
+	w = newTestWebhook(t, []client.Object{configMap("default", "config")}, WithNameEqualsScope(true))
+	expectAllowed(t, w.Handle(context.Background(),
+		updateRequest(t, configMap("default", "config"), configMap("default", "config"))))
+}
+
+func appliedConfigMap(namespace, name, config string) *corev1.ConfigMap {
+	cm := configMap(namespace, name)
+	cm.Annotations = map[string]string{corev1.LastAppliedConfigAnnotation: config}
+	return cm
+}
+
+func TestRecognizeReplacement(t *testing.T) {
+	applied := `{"apiVersion":"v1","kind":"ConfigMap","metadata":{"name":"config-abc","namespace":"default"},"data":{"key":"value"}}`
+	renamed := strings.Replace(applied, "config-abc", "config-def", 1)
+	changed := strings.Replace(renamed, `"value"`, `"other"`, 1)
+
+	w := newTestWebhook(t, []client.Object{terminating(appliedConfigMap("default", "config-abc", applied))},
+		WithIgnoreTerminating(false),
+		WithRecognizeReplacement(true))
+	resp := w.Handle(context.Background(), createRequest(t, appliedConfigMap("default", "config-def", renamed)))
+	expectAllowed(t, resp)
+	if len(resp.Warnings) != 1 || resp.Warnings[0] != `allowed as a replacement for existing instance "config-abc"` {
+		t.Errorf("unexpected warnings %v", resp.Warnings)
+	}
+	expectDenied(t, w.Handle(context.Background(), createRequest(t, appliedConfigMap("default", "config-def", changed))))
+	expectDenied(t, w.Handle(context.Background(), createRequest(t, configMap("default", "config-def"))))
+
+	// Instances which are not being deleted are never replaced, since the
+	// annotation can be copied from them
+	w = newTestWebhook(t, []client.Object{appliedConfigMap("default", "config-abc", applied)},
+		WithIgnoreTerminating(false),
+		WithRecognizeReplacement(true))
+	expectDenied(t, w.Handle(context.Background(), createRequest(t, appliedConfigMap("default", "config-def", renamed))))
+
+	// Without the option, the terminating instance is counted
+	w = newTestWebhook(t, []client.Object{terminating(appliedConfigMap("default", "config-abc", applied))},
+		WithIgnoreTerminating(false))
+	expectDenied(t, w.Handle(context.Background(), createRequest(t, appliedConfigMap("default", "config-def", renamed))))
+}
+
+func TestNameEqualsScopeCombinations(t *testing.T) {
+	for name, opt := range map[string]Option{
+		"scope by user":     WithScopeByUser(true),
+		"owner chain scope": WithOwnerChainScope(1, deploymentGVK),
+		"shard func": WithShardFunc(func(obj *unstructured.Unstructured) (string, error) {
+			return "0", nil
+		}),
+	} {
+		t.Run(name, func(t *testing.T) {
+			w := NewFor(&corev1.ConfigMap{}, WithNameEqualsScope(true), opt)
+			err := w.SetupWithServer(&webhook.Server{}, testScheme, newTestClient())
+			if err == nil || !strings.HasPrefix(err.Error(), "WithNameEqualsScope cannot be combined") {
+				t.Errorf("expected the combination to be rejected, got %v", err)
+			}
+		})
+	}
+}
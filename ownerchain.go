@@ -0,0 +1,99 @@
+package highlander
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+var ErrOwnerChainBroken = errors.New("owner chain could not be resolved")
+
+// WithOwnerChainScope scopes instances by their ancestor of the given kind,
+// found by following ownerReferences up depth levels. For example, a depth
+// of 2 allows only one instance among the children of all children of each
+// root object. The controller reference is followed at each level,
+// or the first owner reference if there is none. Intermediate owners are
+// read using the webhook's client, which is backed by the manager's cache
+// when set up with a manager, and must be in the same namespace as the
+// object.
+//
+// By default, a created object whose owner chain cannot be resolved, for
+// example because an owner is missing or of a different kind, is allowed
+// with a warning. Use WithOwnerChainRequired to deny it instead. Updates of
+// such objects are always allowed with a warning, since an owner may be
+// deleted while its children still exist. Existing instances whose chain
+// cannot be resolved are not counted.
+func WithOwnerChainScope(depth int, rootGVK schema.GroupVersionKind) Option {
+	return func(w *Webhook) {
+		w.ownerChainDepth = depth
+		w.ownerChainRoot = rootGVK
+	}
+}
+
+// WithOwnerChainRequired controls whether a create is denied if its owner
+// chain cannot be resolved. Updates are not affected. See
+// WithOwnerChainScope.
+func WithOwnerChainRequired(required bool) Option {
+	return func(w *Webhook) {
+		w.ownerChainRequired = required
+	}
+}
+
+// ownerChainRootOf returns the UID of the object's ancestor configured with
+// WithOwnerChainScope.
+func (w *Webhook) ownerChainRootOf(
+	ctx context.Context,
+	obj *unstructured.Unstructured,
+) (string, error) {
+	current := obj
+	for level := 1; ; level++ {
+		ref := ownerOf(current)
+		if ref == nil {
+			return "", fmt.Errorf("%w: %s %q has no owner",
+				ErrOwnerChainBroken, current.GetKind(), current.GetName())
+		}
+		gv, err := schema.ParseGroupVersion(ref.APIVersion)
+		if err != nil {
+			return "", fmt.Errorf("%w: %v", ErrOwnerChainBroken, err)
+		}
+		if level == w.ownerChainDepth {
+			if gv.WithKind(ref.Kind).GroupKind() != w.ownerChainRoot.GroupKind() {
+				return "", fmt.Errorf("%w: owner %s %q is not a %s",
+					ErrOwnerChainBroken, ref.Kind, ref.Name, w.ownerChainRoot.Kind)
+			}
+			return string(ref.UID), nil
+		}
+		owner := &unstructured.Unstructured{}
+		owner.SetGroupVersionKind(gv.WithKind(ref.Kind))
+		key := client.ObjectKey{Namespace: obj.GetNamespace(), Name: ref.Name}
+		if err := w.cli.Get(ctx, key, owner); err != nil {
+			return "", fmt.Errorf("%w: failed to get owner %s %q: %v",
+				ErrOwnerChainBroken, ref.Kind, ref.Name, err)
+		}
+		if owner.GetUID() != ref.UID {
+			return "", fmt.Errorf("%w: owner %s %q was replaced",
+				ErrOwnerChainBroken, ref.Kind, ref.Name)
+		}
+		current = owner
+	}
+}
+
+// ownerOf returns the object's controller reference, or its first owner
+// reference if it has no controller.
+func ownerOf(obj *unstructured.Unstructured) *metav1.OwnerReference {
+	refs := obj.GetOwnerReferences()
+	for i := range refs {
+		if refs[i].Controller != nil && *refs[i].Controller {
+			return &refs[i]
+		}
+	}
+	if len(refs) > 0 {
+		return &refs[0]
+	}
+	return nil
+}
@@ -0,0 +1,160 @@
+package highlander
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+var deploymentGVK = schema.GroupVersionKind{Group: "apps", Version: "v1", Kind: "Deployment"}
+
+func ownedBy(obj client.Object, gvk schema.GroupVersionKind, name string) client.Object {
+	controller := true
+	obj.SetOwnerReferences([]metav1.OwnerReference{{
+		APIVersion: gvk.GroupVersion().String(),
+		Kind:       gvk.Kind,
+		Name:       name,
+		UID:        types.UID(name),
+		Controller: &controller,
+	}})
+	return obj
+}
+
+func ownerSecret(name string, ownerKind schema.GroupVersionKind, owner string) client.Object {
+	s := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace: "default",
+			Name:      name,
+			UID:       types.UID(name),
+		},
+	}
+	return ownedBy(s, ownerKind, owner)
+}
+
+func TestOwnerChainScope(t *testing.T) {
+	secretGVK := corev1.SchemeGroupVersion.WithKind("Secret")
+	objs := []client.Object{
+		ownerSecret("s1", deploymentGVK, "d1"),
+		ownerSecret("s2", deploymentGVK, "d1"),
+		ownerSecret("s3", deploymentGVK, "d2"),
+		ownerSecret("s4", schema.GroupVersionKind{Group: "apps", Version: "v1", Kind: "StatefulSet"}, "d1"),
+		ownedBy(configMap("default", "existing"), secretGVK, "s1"),
+	}
+	w := newTestWebhook(t, objs, WithOwnerChainScope(2, deploymentGVK))
+
+	// Instances sharing the root are in the same scope
+	expectDenied(t, w.Handle(context.Background(),
+		createRequest(t, ownedBy(configMap("default", "new"), secretGVK, "s2"))))
+	expectAllowed(t, w.Handle(context.Background(),
+		createRequest(t, ownedBy(configMap("default", "new"), secretGVK, "s3"))))
+
+	// Objects whose chain is broken are allowed with a warning
+	broken := []client.Object{
+		configMap("default", "unowned"),
+		ownedBy(configMap("default", "missing"), secretGVK, "missing"),
+		ownedBy(configMap("default", "root"), secretGVK, "s4"),
+	}
+	for _, obj := range broken {
+		resp := w.Handle(context.Background(), createRequest(t, obj))
+		expectAllowed(t, resp)
+		if len(resp.Warnings) != 1 || !strings.Contains(resp.Warnings[0], ErrOwnerChainBroken.Error()) {
+			t.Errorf("%s: expected a warning about the owner chain, got %v", obj.GetName(), resp.Warnings)
+		}
+	}
+
+	// Updates of objects whose owner was deleted are allowed
+	existing := ownedBy(configMap("default", "existing"), secretGVK, "missing")
+	resp := w.Handle(context.Background(), updateRequest(t, existing, existing))
+	expectAllowed(t, resp)
+	if len(resp.Warnings) != 1 || !strings.Contains(resp.Warnings[0], ErrOwnerChainBroken.Error()) {
+		t.Errorf("expected a warning about the owner chain, got %v", resp.Warnings)
+	}
+}
+
+func TestOwnerChainRequired(t *testing.T) {
+	secretGVK := corev1.SchemeGroupVersion.WithKind("Secret")
+	buf := &bytes.Buffer{}
+	w := newTestWebhook(t, []client.Object{ownerSecret("s1", deploymentGVK, "d1")},
+		WithOwnerChainScope(2, deploymentGVK),
+		WithOwnerChainRequired(true),
+		WithDecisionLog(buf))
+
+	expectAllowed(t, w.Handle(context.Background(),
+		createRequest(t, ownedBy(configMap("default", "new"), secretGVK, "s1"))))
+	for _, obj := range []client.Object{
+		configMap("default", "unowned"),
+		ownedBy(configMap("default", "missing"), secretGVK, "missing"),
+	} {
+		resp := w.Handle(context.Background(), createRequest(t, obj))
+		expectDenied(t, resp)
+		if !strings.HasPrefix(string(resp.Result.Reason), ErrOwnerChainBroken.Error()) {
+			t.Errorf("%s: expected an owner chain denial, got %q", obj.GetName(), resp.Result.Reason)
+		}
+	}
+
+	if records := readDecisions(t, buf); len(records) != 2 || records[0].Decision != DecisionDenied {
+		t.Errorf("expected the denials to be logged, got %+v", records)
+	}
+
+	// Updates are always allowed, for example for the garbage collector to
+	// remove the owner reference of an orphaned object
+	existing := ownedBy(configMap("default", "existing"), secretGVK, "missing")
+	resp := w.Handle(context.Background(), updateRequest(t, existing, configMap("default", "existing")))
+	expectAllowed(t, resp)
+	resp = w.Handle(context.Background(), updateRequest(t, existing, existing))
+	expectAllowed(t, resp)
+	if len(resp.Warnings) != 1 || !strings.Contains(resp.Warnings[0], ErrOwnerChainBroken.Error()) {
+		t.Errorf("expected a warning about the owner chain, got %v", resp.Warnings)
+	}
+
+	// In advisory mode, the denial becomes a warning
+	w = newTestWebhook(t, nil,
+		WithOwnerChainScope(2, deploymentGVK),
+		WithOwnerChainRequired(true),
+		WithEnforcementMode(EnforcementAdvisory))
+	resp = w.Handle(context.Background(), createRequest(t, configMap("default", "unowned")))
+	expectAllowed(t, resp)
+	if len(resp.Warnings) != 1 || !strings.HasPrefix(resp.Warnings[0], "advisory: would be denied: "+ErrOwnerChainBroken.Error()) {
+		t.Errorf("expected an advisory warning, got %v", resp.Warnings)
+	}
+}
+
+// countingClient counts the objects read with Get.
+type countingClient struct {
+	client.Client
+	gets *int
+}
+
+func (c countingClient) Get(ctx context.Context, key client.ObjectKey, obj client.Object) error {
+	*c.gets++
+	return c.Client.Get(ctx, key, obj)
+}
+
+func TestOwnerChainLookedUpOncePerItem(t *testing.T) {
+	secretGVK := corev1.SchemeGroupVersion.WithKind("Secret")
+	gets := 0
+	c := countingClient{
+		Client: newTestClient(
+			ownerSecret("s1", deploymentGVK, "d1"),
+			ownerSecret("s2", deploymentGVK, "d1"),
+			ownedBy(configMap("default", "existing"), secretGVK, "s1"),
+		),
+		gets: &gets,
+	}
+	w := newTestWebhookFor(t, &corev1.ConfigMap{}, c, WithOwnerChainScope(2, deploymentGVK))
+
+	expectDenied(t, w.Handle(context.Background(),
+		createRequest(t, ownedBy(configMap("default", "new"), secretGVK, "s2"))))
+	// One lookup for the incoming object's owner, and one for the existing
+	// instance's owner
+	if gets != 2 {
+		t.Errorf("expected 2 owner lookups, got %d", gets)
+	}
+}
@@ -0,0 +1,106 @@
+package highlander
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// pauses holds the namespaces in which enforcement is paused, and the time
+// until which each is paused.
+type pauses struct {
+	mu    sync.Mutex
+	until map[string]time.Time
+}
+
+// PauseNamespace pauses enforcement in the namespace until the given time.
+// While paused, creates in the namespace are allowed with a warning without
+// being checked. Enforcement resumes automatically at the deadline, or
+// immediately if the time is not in the future.
+func (w *Webhook) PauseNamespace(namespace string, until time.Time) {
+	w.pauses.mu.Lock()
+	defer w.pauses.mu.Unlock()
+	if !until.After(time.Now()) {
+		delete(w.pauses.until, namespace)
+		return
+	}
+	if w.pauses.until == nil {
+		w.pauses.until = map[string]time.Time{}
+	}
+	w.pauses.until[namespace] = until
+}
+
+// PausedNamespaces returns the namespaces in which enforcement is currently
+// paused, and the time until which each is paused.
+func (w *Webhook) PausedNamespaces() map[string]time.Time {
+	w.pauses.mu.Lock()
+	defer w.pauses.mu.Unlock()
+	now := time.Now()
+	paused := make(map[string]time.Time, len(w.pauses.until))
+	for namespace, until := range w.pauses.until {
+		if until.After(now) {
+			paused[namespace] = until
+		} else {
+			delete(w.pauses.until, namespace)
+		}
+	}
+	return paused
+}
+
+// pausedUntil returns the time until which enforcement is paused in the
+// namespace, if it is paused.
+func (w *Webhook) pausedUntil(namespace string) (time.Time, bool) {
+	w.pauses.mu.Lock()
+	defer w.pauses.mu.Unlock()
+	until, ok := w.pauses.until[namespace]
+	if !ok {
+		return time.Time{}, false
+	}
+	if !until.After(time.Now()) {
+		delete(w.pauses.until, namespace)
+		return time.Time{}, false
+	}
+	return until, true
+}
+
+// PauseHandler returns an http.Handler which pauses enforcement of the given
+// webhooks in a namespace. A POST request with the namespace and duration
+// query parameters, such as "?namespace=foo&duration=15m", pauses the
+// namespace for that long, and a duration of 0 resumes it. A GET request
+// writes the currently paused namespaces of each webhook as JSON. Like
+// DebugHandler, it can be mounted on the manager's metrics server using
+// mgr.AddMetricsExtraHandler, and should not be exposed to untrusted users.
+func PauseHandler(webhooks ...*Webhook) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+		case http.MethodPost:
+			namespace := r.URL.Query().Get("namespace")
+			if namespace == "" {
+				http.Error(rw, "namespace is required", http.StatusBadRequest)
+				return
+			}
+			duration, err := time.ParseDuration(r.URL.Query().Get("duration"))
+			if err != nil {
+				http.Error(rw, "invalid duration: "+err.Error(), http.StatusBadRequest)
+				return
+			}
+			until := time.Now().Add(duration)
+			for _, w := range webhooks {
+				w.PauseNamespace(namespace, until)
+			}
+		default:
+			http.Error(rw, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		paused := make(map[string]map[string]time.Time, len(webhooks))
+		for _, w := range webhooks {
+			paused[w.gvk.String()] = w.PausedNamespaces()
+		}
+		rw.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(rw).Encode(paused); err != nil {
+			http.Error(rw, err.Error(), http.StatusInternalServerError)
+		}
+	})
+}
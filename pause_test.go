@@ -0,0 +1,101 @@
+package highlander
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+func TestPauseNamespace(t *testing.T) {
+	w := newTestWebhook(t, []client.Object{configMap("default", "existing")})
+	until := time.Now().Add(time.Hour)
+	w.PauseNamespace("default", until)
+
+	resp := w.Handle(context.Background(), createRequest(t, configMap("default", "new")))
+	expectAllowed(t, resp)
+	if len(resp.Warnings) != 1 || !strings.HasPrefix(resp.Warnings[0], `enforcement is paused in namespace "default" until `) {
+		t.Errorf("unexpected warnings %v", resp.Warnings)
+	}
+	if paused := w.PausedNamespaces(); len(paused) != 1 || !paused["default"].Equal(until) {
+		t.Errorf("unexpected paused namespaces %v", paused)
+	}
+
+	// A time which is not in the future resumes enforcement
+	w.PauseNamespace("default", time.Now())
+	expectDenied(t, w.Handle(context.Background(), createRequest(t, configMap("default", "new"))))
+	if paused := w.PausedNamespaces(); len(paused) != 0 {
+		t.Errorf("unexpected paused namespaces %v", paused)
+	}
+
+	// Enforcement resumes automatically at the deadline
+	w.PauseNamespace("default", time.Now().Add(10*time.Millisecond))
+	expectAllowed(t, w.Handle(context.Background(), createRequest(t, configMap("default", "new"))))
+	time.Sleep(20 * time.Millisecond)
+	expectDenied(t, w.Handle(context.Background(), createRequest(t, configMap("default", "new"))))
+	if paused := w.PausedNamespaces(); len(paused) != 0 {
+		t.Errorf("unexpected paused namespaces %v", paused)
+	}
+}
+
+func TestPauseHandler(t *testing.T) {
+	configMaps := newTestWebhook(t, []client.Object{configMap("default", "existing")})
+	volumes := newTestWebhookFor(t, &corev1.PersistentVolume{}, newTestClient())
+	h := PauseHandler(configMaps, volumes)
+	serve := func(method, target string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(method, target, nil))
+		return rec
+	}
+	decode := func(t *testing.T, rec *httptest.ResponseRecorder) map[string]map[string]time.Time {
+		t.Helper()
+		if rec.Code != http.StatusOK {
+			t.Fatalf("unexpected status %d: %s", rec.Code, rec.Body.String())
+		}
+		if ct := rec.Header().Get("Content-Type"); ct != "application/json" {
+			t.Errorf("unexpected content type %q", ct)
+		}
+		var paused map[string]map[string]time.Time
+		if err := json.Unmarshal(rec.Body.Bytes(), &paused); err != nil {
+			t.Fatal(err)
+		}
+		return paused
+	}
+
+	paused := decode(t, serve(http.MethodPost, "/?namespace=default&duration=15m"))
+	for _, gvk := range []string{configMapGVK.String(), corev1.SchemeGroupVersion.WithKind("PersistentVolume").String()} {
+		until, ok := paused[gvk]["default"]
+		if !ok || time.Until(until) < 14*time.Minute || time.Until(until) > 15*time.Minute {
+			t.Errorf("expected %s to be paused for 15m, got %v", gvk, paused[gvk])
+		}
+	}
+	expectAllowed(t, configMaps.Handle(context.Background(), createRequest(t, configMap("default", "new"))))
+	if paused := decode(t, serve(http.MethodGet, "/")); len(paused[configMapGVK.String()]) != 1 {
+		t.Errorf("unexpected paused namespaces %v", paused)
+	}
+
+	paused = decode(t, serve(http.MethodPost, "/?namespace=default&duration=0"))
+	if len(paused[configMapGVK.String()]) != 0 {
+		t.Errorf("expected enforcement to resume, got %v", paused)
+	}
+	expectDenied(t, configMaps.Handle(context.Background(), createRequest(t, configMap("default", "new"))))
+
+	for _, c := range []struct {
+		method, target string
+		code           int
+	}{
+		{http.MethodPost, "/?duration=15m", http.StatusBadRequest},
+		{http.MethodPost, "/?namespace=default&duration=soon", http.StatusBadRequest},
+		{http.MethodDelete, "/", http.StatusMethodNotAllowed},
+	} {
+		if rec := serve(c.method, c.target); rec.Code != c.code {
+			t.Errorf("%s %s: expected status %d, got %d", c.method, c.target, c.code, rec.Code)
+		}
+	}
+}
@@ -0,0 +1,45 @@
+package highlander
+
+import (
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+// Policy limits the number of instances of an object in each scope.
+type Policy struct {
+	// Max is the maximum number of matching instances allowed in each scope.
+	// Defaults to 1 if unset.
+	Max int
+	// Selector restricts the policy to objects whose labels match. The
+	// policy applies to all objects if nil.
+	Selector labels.Selector
+}
+
+type namedPolicy struct {
+	Policy
+	name string
+}
+
+func (p namedPolicy) max() int {
+	if p.Max <= 0 {
+		return 1
+	}
+	return p.Max
+}
+
+func (p namedPolicy) matches(obj *unstructured.Unstructured) bool {
+	return p.Selector == nil || p.Selector.Matches(labels.Set(obj.GetLabels()))
+}
+
+// WithPolicy adds a named policy to the webhook. Each policy is evaluated
+// independently, and a create is denied if it would violate any of them.
+// When any policies are configured, they replace the default rule of one
+// instance per scope, and WithUniqueLabelValue has no effect.
+func WithPolicy(name string, policy Policy) Option {
+	return func(w *Webhook) {
+		w.policies = append(w.policies, namedPolicy{
+			Policy: policy,
+			name:   name,
+		})
+	}
+}
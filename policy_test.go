@@ -0,0 +1,68 @@
+package highlander
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"k8s.io/apimachinery/pkg/labels"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+func TestPolicies(t *testing.T) {
+	leader := map[string]string{"role": "leader"}
+	worker := map[string]string{"role": "worker"}
+	policies := []Option{
+		WithPolicy("three-total", Policy{Max: 3}),
+		WithPolicy("one-leader", Policy{
+			Selector: labels.SelectorFromSet(labels.Set(leader)),
+		}),
+	}
+	w := newTestWebhook(t, []client.Object{
+		labeledConfigMap("default", "leader", leader),
+		labeledConfigMap("default", "worker-1", worker),
+	}, policies...)
+
+	// The total count policy passes, but the leader policy does not
+	resp := w.Handle(context.Background(), createRequest(t, labeledConfigMap("default", "leader-2", leader)))
+	expectDenied(t, resp)
+	if reason := string(resp.Result.Reason); reason != `policy violated: "one-leader" allows at most 1 matching instance(s) per scope` {
+		t.Errorf("unexpected reason %q", reason)
+	}
+	_, err := w.ValidateCreate(context.Background(),
+		toUnstructured(t, labeledConfigMap("default", "leader-2", leader)))
+	var conflict *ConflictError
+	if !errors.As(err, &conflict) || !errors.Is(err, ErrPolicyViolated) {
+		t.Fatalf("expected a policy conflict, got %v", err)
+	}
+	if len(conflict.Conflicts) != 1 || conflict.Conflicts[0] != "leader" {
+		t.Errorf("expected only the matching leader to be named, got %v", conflict.Conflicts)
+	}
+	expectAllowed(t, w.Handle(context.Background(),
+		createRequest(t, labeledConfigMap("default", "worker-2", worker))))
+	expectAllowed(t, w.Handle(context.Background(),
+		createRequest(t, labeledConfigMap("other", "leader", leader))))
+
+	// The leader policy passes, but the total count policy does not
+	w = newTestWebhook(t, []client.Object{
+		labeledConfigMap("default", "worker-1", worker),
+		labeledConfigMap("default", "worker-2", worker),
+		labeledConfigMap("default", "worker-3", worker),
+	}, policies...)
+	resp = w.Handle(context.Background(), createRequest(t, labeledConfigMap("default", "leader", leader)))
+	expectDenied(t, resp)
+	if reason := string(resp.Result.Reason); reason != `policy violated: "three-total" allows at most 3 matching instance(s) per scope` {
+		t.Errorf("unexpected reason %q", reason)
+	}
+	_, err = w.ValidateCreate(context.Background(),
+		toUnstructured(t, labeledConfigMap("default", "leader", leader)))
+	if !errors.As(err, &conflict) || len(conflict.Conflicts) != 3 {
+		t.Errorf("expected all instances to be named, got %v", err)
+	}
+}
+
+func TestPoliciesReplaceDefaultRule(t *testing.T) {
+	w := newTestWebhook(t, []client.Object{configMap("default", "existing")},
+		WithPolicy("two", Policy{Max: 2}))
+	expectAllowed(t, w.Handle(context.Background(), createRequest(t, configMap("default", "second"))))
+}
@@ -0,0 +1,97 @@
+package highlander
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// WithCreateRateLimit allows at most max creates in each scope within any
+// period of the given window, regardless of whether earlier instances have
+// since been deleted. This protects downstream systems from instances being
+// rapidly deleted and recreated. Creates beyond the limit are denied with a
+// hint of when to retry, before any lease or lock is acquired for them.
+// Updates which move an object into the scope are not limited. Admitted
+// creates are tracked in memory, so each replica of the webhook enforces
+// the limit separately.
+func WithCreateRateLimit(max int, window time.Duration) Option {
+	return func(w *Webhook) {
+		w.createRateLimit = &createRateLimit{
+			max:    max,
+			window: window,
+		}
+	}
+}
+
+// createRateLimit is a sliding window of the times at which creates were
+// admitted, for each scope.
+type createRateLimit struct {
+	max    int
+	window time.Duration
+
+	mu      sync.Mutex
+	creates map[string][]time.Time
+}
+
+// allow returns whether a create in the scope at the given time is within
+// the limit, and if not, how long until it would be. If record is true and
+// the create is allowed, it is counted toward the limit.
+func (l *createRateLimit) allow(scope string, now time.Time, record bool) (bool, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.creates == nil {
+		l.creates = map[string][]time.Time{}
+	}
+	cutoff := now.Add(-l.window)
+	times := l.creates[scope]
+	for len(times) > 0 && !times[0].After(cutoff) {
+		times = times[1:]
+	}
+	if len(times) >= l.max {
+		l.creates[scope] = times
+		if l.max <= 0 {
+			return false, l.window
+		}
+		return false, times[len(times)-l.max].Sub(cutoff)
+	}
+	if record {
+		times = append(times, now)
+	}
+	if len(times) == 0 {
+		delete(l.creates, scope)
+	} else {
+		l.creates[scope] = times
+	}
+	return true, 0
+}
+
+// cancel stops counting a create recorded by allow at the given time, for
+// a create which was denied afterwards.
+func (l *createRateLimit) cancel(scope string, at time.Time) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	times := l.creates[scope]
+	for i := len(times) - 1; i >= 0; i-- {
+		if times[i].Equal(at) {
+			times = append(times[:i:i], times[i+1:]...)
+			break
+		}
+	}
+	if len(times) == 0 {
+		delete(l.creates, scope)
+	} else {
+		l.creates[scope] = times
+	}
+}
+
+// rateLimitError is returned by validateCreate for a create which exceeds
+// the limit set with WithCreateRateLimit.
+type rateLimitError struct {
+	limit      *createRateLimit
+	retryAfter time.Duration
+}
+
+func (e *rateLimitError) Error() string {
+	return fmt.Sprintf("at most %d instance(s) can be created per %s in this scope",
+		e.limit.max, e.limit.window)
+}
@@ -0,0 +1,101 @@
+package highlander
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+)
+
+func TestCreateRateLimitAllow(t *testing.T) {
+	l := &createRateLimit{max: 2, window: time.Minute}
+	t0 := time.Now()
+	expect := func(t *testing.T, scope string, now time.Time, record, allowed bool, retryAfter time.Duration) {
+		t.Helper()
+		ok, after := l.allow(scope, now, record)
+		if ok != allowed || after != retryAfter {
+			t.Errorf("expected %v, %s at %s, got %v, %s", allowed, retryAfter, now.Sub(t0), ok, after)
+		}
+	}
+
+	expect(t, "a", t0, true, true, 0)
+	// Creates which are not recorded are not counted
+	expect(t, "a", t0.Add(5*time.Second), false, true, 0)
+	expect(t, "a", t0.Add(10*time.Second), true, true, 0)
+	expect(t, "a", t0.Add(20*time.Second), true, false, 40*time.Second)
+	expect(t, "b", t0.Add(20*time.Second), true, true, 0)
+	// The window slides
+	expect(t, "a", t0.Add(time.Minute+time.Second), true, true, 0)
+	expect(t, "a", t0.Add(time.Minute+2*time.Second), true, false, 8*time.Second)
+
+	// Cancelled creates are no longer counted
+	l.cancel("a", t0.Add(time.Minute+time.Second))
+	expect(t, "a", t0.Add(time.Minute+2*time.Second), true, true, 0)
+	l.cancel("b", t0.Add(20*time.Second))
+	if _, ok := l.creates["b"]; ok {
+		t.Error("expected the scope to be removed once empty")
+	}
+
+	none := &createRateLimit{max: 0, window: time.Minute}
+	if ok, after := none.allow("a", t0, true); ok || after != time.Minute {
+		t.Errorf("expected creates to be denied for the window, got %v, %s", ok, after)
+	}
+}
+
+func TestCreateRateLimit(t *testing.T) {
+	w := newTestWebhook(t, nil, WithCreateRateLimit(1, time.Hour))
+
+	// Dry runs are checked but not counted
+	req := createRequest(t, configMap("default", "new"))
+	dryRun := true
+	req.DryRun = &dryRun
+	expectAllowed(t, w.Handle(context.Background(), req))
+
+	expectAllowed(t, w.Handle(context.Background(), createRequest(t, configMap("default", "new"))))
+	resp := w.Handle(context.Background(), createRequest(t, configMap("default", "new")))
+	expectRateLimited(t, resp)
+	expectRateLimited(t, w.Handle(context.Background(), req))
+	expectAllowed(t, w.Handle(context.Background(), createRequest(t, configMap("other", "new"))))
+}
+
+func TestCreateRateLimitUpdates(t *testing.T) {
+	w := newTestWebhook(t, nil, WithCreateRateLimit(1, time.Hour), WithScopeField("data", "zone"))
+	expectAllowed(t, w.Handle(context.Background(), createRequest(t, zoneConfigMap("default", "a", "west"))))
+	expectRateLimited(t, w.Handle(context.Background(), createRequest(t, zoneConfigMap("default", "b", "west"))))
+
+	// Moving an object into the scope is not limited
+	expectAllowed(t, w.Handle(context.Background(),
+		updateRequest(t, zoneConfigMap("default", "c", "east"), zoneConfigMap("default", "c", "west"))))
+}
+
+func TestCreateRateLimitReleasedOnConflict(t *testing.T) {
+	backend := NewMemoryLockBackend()
+	w := newTestWebhook(t, nil, WithCreateRateLimit(1, time.Hour), WithLockBackend(backend, "east"))
+	ctx := context.Background()
+	if ok, _ := backend.Acquire(ctx, "ConfigMap/default", "west/default/other", time.Hour); !ok {
+		t.Fatal("expected the lock to be acquired")
+	}
+
+	// The create is denied by the lock, and is not counted
+	expectDenied(t, w.Handle(ctx, createRequest(t, configMap("default", "new"))))
+	if err := backend.Release(ctx, "ConfigMap/default", "west/default/other"); err != nil {
+		t.Fatal(err)
+	}
+	expectAllowed(t, w.Handle(ctx, createRequest(t, configMap("default", "new"))))
+	expectRateLimited(t, w.Handle(ctx, createRequest(t, configMap("default", "new"))))
+}
+
+func expectRateLimited(t *testing.T, resp admission.Response) {
+	t.Helper()
+	expectDenied(t, resp)
+	reason := string(resp.Result.Reason)
+	if !strings.HasPrefix(reason, "at most 1 instance(s) can be created per 1h0m0s in this scope, retry after ") {
+		t.Errorf("unexpected reason %q", reason)
+	}
+	if resp.Result.Details == nil || resp.Result.Details.RetryAfterSeconds < 3590 ||
+		resp.Result.Details.RetryAfterSeconds > 3600 {
+		t.Errorf("expected a retry after about an hour, got %+v", resp.Result.Details)
+	}
+}
@@ -0,0 +1,170 @@
+package highlander
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"time"
+)
+
+// acquireScript sets the lock if it is not held, or renews it if it is held
+// by the same holder.
+const acquireScript = `local v = redis.call("GET", KEYS[1])
+if v == false or v == ARGV[1] then
+	redis.call("SET", KEYS[1], ARGV[1], "PX", ARGV[2])
+	return 1
+end
+return 0`
+
+// releaseScript deletes the lock only if it is held by the holder.
+const releaseScript = `if redis.call("GET", KEYS[1]) == ARGV[1] then
+	return redis.call("DEL", KEYS[1])
+end
+return 0`
+
+// RedisLockBackend is a LockBackend which stores locks in a Redis server,
+// which can be shared by webhooks in several clusters. Each lock is a key
+// holding the holder identity, with an expiry set to the lock's time to
+// live. Acquiring and releasing locks use Lua scripts, so that a lock is
+// only ever changed by its holder. A new connection is made for each
+// operation.
+type RedisLockBackend struct {
+	// Addr is the address of the Redis server, as host:port.
+	Addr string
+	// Password is used to authenticate with the server, if set.
+	Password string
+	// DB is the database to select, if not 0.
+	DB int
+	// KeyPrefix is prepended to the key of each lock.
+	KeyPrefix string
+	// Dial connects to the server. If nil, a plain TCP connection to Addr
+	// is made. This can be used to connect using TLS.
+	Dial func(ctx context.Context) (net.Conn, error)
+}
+
+var _ LockBackend = (*RedisLockBackend)(nil)
+
+func (b *RedisLockBackend) Acquire(
+	ctx context.Context,
+	key, holder string,
+	ttl time.Duration,
+) (bool, error) {
+	reply, err := b.do(ctx, "EVAL", acquireScript, "1", b.KeyPrefix+key,
+		holder, strconv.FormatInt(ttl.Milliseconds(), 10))
+	if err != nil {
+		return false, err
+	}
+	n, ok := reply.(int64)
+	if !ok {
+		return false, fmt.Errorf("unexpected reply from redis: %v", reply)
+	}
+	return n == 1, nil
+}
+
+func (b *RedisLockBackend) Release(ctx context.Context, key, holder string) error {
+	_, err := b.do(ctx, "EVAL", releaseScript, "1", b.KeyPrefix+key, holder)
+	return err
+}
+
+func (b *RedisLockBackend) IsHeld(ctx context.Context, key string) (string, bool, error) {
+	reply, err := b.do(ctx, "GET", b.KeyPrefix+key)
+	if err != nil {
+		return "", false, err
+	}
+	if reply == nil {
+		return "", false, nil
+	}
+	holder, ok := reply.(string)
+	if !ok {
+		return "", false, fmt.Errorf("unexpected reply from redis: %v", reply)
+	}
+	return holder, true, nil
+}
+
+// do connects to the server and runs a single command, after authenticating
+// and selecting the database if configured.
+func (b *RedisLockBackend) do(ctx context.Context, args ...string) (interface{}, error) {
+	var conn net.Conn
+	var err error
+	if b.Dial != nil {
+		conn, err = b.Dial(ctx)
+	} else {
+		var d net.Dialer
+		conn, err = d.DialContext(ctx, "tcp", b.Addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		if err := conn.SetDeadline(deadline); err != nil {
+			return nil, err
+		}
+	}
+
+	rw := bufio.NewReadWriter(bufio.NewReader(conn), bufio.NewWriter(conn))
+	if b.Password != "" {
+		if _, err := redisCommand(rw, "AUTH", b.Password); err != nil {
+			return nil, err
+		}
+	}
+	if b.DB != 0 {
+		if _, err := redisCommand(rw, "SELECT", strconv.Itoa(b.DB)); err != nil {
+			return nil, err
+		}
+	}
+	return redisCommand(rw, args...)
+}
+
+// redisCommand writes a command using the RESP protocol and reads its reply.
+func redisCommand(rw *bufio.ReadWriter, args ...string) (interface{}, error) {
+	fmt.Fprintf(rw, "*%d\r\n", len(args))
+	for _, arg := range args {
+		fmt.Fprintf(rw, "$%d\r\n%s\r\n", len(arg), arg)
+	}
+	if err := rw.Flush(); err != nil {
+		return nil, err
+	}
+	return readRedisReply(rw.Reader)
+}
+
+// readRedisReply reads a single RESP reply. Bulk strings are returned as
+// strings, integers as int64, and nil bulk strings as nil. Arrays are not
+// used by the lock commands and are not supported.
+func readRedisReply(r *bufio.Reader) (interface{}, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	if len(line) < 3 || line[len(line)-2] != '\r' {
+		return nil, errors.New("malformed reply from redis")
+	}
+	line = line[:len(line)-2]
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+	case '-':
+		return nil, fmt.Errorf("redis: %s", line[1:])
+	case ':':
+		return strconv.ParseInt(line[1:], 10, 64)
+	case '$':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, err
+		}
+		if n < 0 {
+			return nil, nil
+		}
+		buf := make([]byte, n+2)
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return nil, err
+		}
+		return string(buf[:n]), nil
+	default:
+		return nil, fmt.Errorf("unsupported reply from redis: %q", line)
+	}
+}
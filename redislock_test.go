@@ -0,0 +1,267 @@
+package highlander
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeRedis is a Redis server which implements the commands and scripts
+// used by RedisLockBackend.
+type fakeRedis struct {
+	listener net.Listener
+	password string
+
+	mu   sync.Mutex
+	dbs  map[int]map[string]memoryLock
+	cmds []string
+}
+
+func newFakeRedis(t *testing.T, password string) *fakeRedis {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &fakeRedis{
+		listener: l,
+		password: password,
+		dbs:      map[int]map[string]memoryLock{},
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn)
+		}
+	}()
+	return s
+}
+
+func (s *fakeRedis) addr() string {
+	return s.listener.Addr().String()
+}
+
+func (s *fakeRedis) commands() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.cmds...)
+}
+
+func (s *fakeRedis) serve(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	authed := s.password == ""
+	db := 0
+	for {
+		args, err := readRedisCommand(r)
+		if err != nil {
+			return
+		}
+		s.mu.Lock()
+		s.cmds = append(s.cmds, args[0])
+		var reply string
+		switch {
+		case args[0] == "AUTH":
+			if args[1] != s.password {
+				reply = "-WRONGPASS invalid password"
+				break
+			}
+			authed = true
+			reply = "+OK"
+		case !authed:
+			reply = "-NOAUTH Authentication required."
+		case args[0] == "SELECT":
+			db, _ = strconv.Atoi(args[1])
+			reply = "+OK"
+		default:
+			reply = s.run(db, args)
+		}
+		s.mu.Unlock()
+		fmt.Fprintf(conn, "%s\r\n", reply)
+	}
+}
+
+func (s *fakeRedis) run(db int, args []string) string {
+	if s.dbs[db] == nil {
+		s.dbs[db] = map[string]memoryLock{}
+	}
+	locks := s.dbs[db]
+	get := func(key string) (string, bool) {
+		lock, ok := locks[key]
+		if !ok || !lock.expires.After(time.Now()) {
+			return "", false
+		}
+		return lock.holder, true
+	}
+	switch args[0] {
+	case "GET":
+		holder, ok := get(args[1])
+		if !ok {
+			return "$-1"
+		}
+		return fmt.Sprintf("$%d\r\n%s", len(holder), holder)
+	case "EVAL":
+		key, holder := args[3], args[4]
+		current, held := get(key)
+		switch args[1] {
+		case acquireScript:
+			if held && current != holder {
+				return ":0"
+			}
+			ms, _ := strconv.Atoi(args[5])
+			locks[key] = memoryLock{
+				holder:  holder,
+				expires: time.Now().Add(time.Duration(ms) * time.Millisecond),
+			}
+			return ":1"
+		case releaseScript:
+			if held && current == holder {
+				delete(locks, key)
+				return ":1"
+			}
+			return ":0"
+		}
+	}
+	return "-ERR unknown command"
+}
+
+func readRedisCommand(r *bufio.Reader) ([]string, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	n, err := strconv.Atoi(strings.TrimSpace(strings.TrimPrefix(line, "*")))
+	if err != nil {
+		return nil, err
+	}
+	args := make([]string, n)
+	for i := range args {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		size, err := strconv.Atoi(strings.TrimSpace(strings.TrimPrefix(line, "$")))
+		if err != nil {
+			return nil, err
+		}
+		buf := make([]byte, size+2)
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return nil, err
+		}
+		args[i] = string(buf[:size])
+	}
+	return args, nil
+}
+
+func TestRedisLockBackend(t *testing.T) {
+	ctx := context.Background()
+	server := newFakeRedis(t, "")
+	b := &RedisLockBackend{Addr: server.addr(), KeyPrefix: "highlander/"}
+
+	if ok, err := b.Acquire(ctx, "key", "a", time.Minute); err != nil || !ok {
+		t.Fatalf("expected the lock to be acquired, got %v, %v", ok, err)
+	}
+	if ok, err := b.Acquire(ctx, "key", "b", time.Minute); err != nil || ok {
+		t.Errorf("expected the lock to be held by a, got %v, %v", ok, err)
+	}
+	if ok, _ := b.Acquire(ctx, "key", "a", time.Minute); !ok {
+		t.Error("expected the holder to renew the lock")
+	}
+	if holder, held, err := b.IsHeld(ctx, "key"); err != nil || !held || holder != "a" {
+		t.Errorf("expected the lock to be held by a, got %q, %v, %v", holder, held, err)
+	}
+	// Keys are prefixed
+	if holder, held, _ := (&RedisLockBackend{Addr: server.addr()}).IsHeld(ctx, "highlander/key"); !held || holder != "a" {
+		t.Errorf("expected the key to be prefixed, got %q, %v", holder, held)
+	}
+
+	if err := b.Release(ctx, "key", "b"); err != nil {
+		t.Fatal(err)
+	}
+	if _, held, _ := b.IsHeld(ctx, "key"); !held {
+		t.Error("lock was released by another holder")
+	}
+	if err := b.Release(ctx, "key", "a"); err != nil {
+		t.Fatal(err)
+	}
+	if holder, held, err := b.IsHeld(ctx, "key"); err != nil || held {
+		t.Errorf("expected the lock to be released, got %q, %v, %v", holder, held, err)
+	}
+
+	if ok, _ := b.Acquire(ctx, "key", "a", 5*time.Millisecond); !ok {
+		t.Fatal("expected the lock to be acquired")
+	}
+	time.Sleep(10 * time.Millisecond)
+	if ok, _ := b.Acquire(ctx, "key", "b", time.Minute); !ok {
+		t.Error("expected the expired lock to be acquired by b")
+	}
+}
+
+func TestRedisLockBackendAuthAndSelect(t *testing.T) {
+	ctx := context.Background()
+	server := newFakeRedis(t, "secret")
+
+	unauthenticated := &RedisLockBackend{Addr: server.addr()}
+	if _, err := unauthenticated.Acquire(ctx, "key", "a", time.Minute); err == nil ||
+		!strings.Contains(err.Error(), "NOAUTH") {
+		t.Errorf("expected an authentication error, got %v", err)
+	}
+	wrong := &RedisLockBackend{Addr: server.addr(), Password: "wrong"}
+	if _, _, err := wrong.IsHeld(ctx, "key"); err == nil || !strings.Contains(err.Error(), "WRONGPASS") {
+		t.Errorf("expected an authentication error, got %v", err)
+	}
+
+	b := &RedisLockBackend{Addr: server.addr(), Password: "secret", DB: 2}
+	if ok, err := b.Acquire(ctx, "key", "a", time.Minute); err != nil || !ok {
+		t.Fatalf("expected the lock to be acquired, got %v, %v", ok, err)
+	}
+	// The lock is only held in the selected database
+	other := &RedisLockBackend{Addr: server.addr(), Password: "secret"}
+	if _, held, _ := other.IsHeld(ctx, "key"); held {
+		t.Error("expected the lock to be held in database 2 only")
+	}
+	if _, held, _ := b.IsHeld(ctx, "key"); !held {
+		t.Error("expected the lock to be held in database 2")
+	}
+}
+
+func TestRedisLockBackendDial(t *testing.T) {
+	server := newFakeRedis(t, "")
+	dialed := 0
+	b := &RedisLockBackend{
+		Dial: func(ctx context.Context) (net.Conn, error) {
+			dialed++
+			var d net.Dialer
+			return d.DialContext(ctx, "tcp", server.addr())
+		},
+	}
+	if ok, err := b.Acquire(context.Background(), "key", "a", time.Minute); err != nil || !ok {
+		t.Fatalf("expected the lock to be acquired, got %v, %v", ok, err)
+	}
+	if dialed != 1 {
+		t.Errorf("expected Dial to be used, dialed %d times", dialed)
+	}
+	if cmds := server.commands(); len(cmds) != 1 || cmds[0] != "EVAL" {
+		t.Errorf("expected a single EVAL command, got %v", cmds)
+	}
+}
+
+func TestRedisLockBackendWithWebhook(t *testing.T) {
+	server := newFakeRedis(t, "")
+	east := newTestWebhook(t, nil, WithLockBackend(&RedisLockBackend{Addr: server.addr()}, "east"))
+	west := newTestWebhook(t, nil, WithLockBackend(&RedisLockBackend{Addr: server.addr()}, "west"))
+
+	expectAllowed(t, east.Handle(context.Background(), createRequest(t, configMap("default", "singleton"))))
+	expectDenied(t, west.Handle(context.Background(), createRequest(t, configMap("default", "singleton"))))
+}
@@ -0,0 +1,46 @@
+package highlander
+
+import (
+	"encoding/json"
+	"reflect"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+// isReplacement returns whether the incoming object replaces the existing
+// item, which is the case if the item is being deleted and the object was
+// applied from the same configuration, ignoring the name. The requester
+// controls the incoming annotation and can copy it from the item, so the
+// item being deleted is what makes this safe: only the API server sets the
+// deletion timestamp, once someone allowed to delete the item has done so.
+// See WithRecognizeReplacement.
+func isReplacement(obj, item *unstructured.Unstructured) bool {
+	if item.GetDeletionTimestamp() == nil {
+		return false
+	}
+	incoming, ok := lastApplied(obj)
+	if !ok {
+		return false
+	}
+	existing, ok := lastApplied(item)
+	if !ok {
+		return false
+	}
+	return reflect.DeepEqual(incoming, existing)
+}
+
+// lastApplied returns the object's last applied configuration without its
+// name, or false if it has none.
+func lastApplied(obj *unstructured.Unstructured) (map[string]interface{}, bool) {
+	data, ok := obj.GetAnnotations()[corev1.LastAppliedConfigAnnotation]
+	if !ok || data == "" {
+		return nil, false
+	}
+	config := map[string]interface{}{}
+	if err := json.Unmarshal([]byte(data), &config); err != nil {
+		return nil, false
+	}
+	unstructured.RemoveNestedField(config, "metadata", "name")
+	return config, true
+}
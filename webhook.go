@@ -3,102 +3,1267 @@ package highlander
 import (
 	"context"
 	"errors"
+	"fmt"
+	"math"
 	"net/http"
+	"regexp"
+	"strconv"
 	"strings"
+	"sync/atomic"
+	"time"
 
 	"github.com/go-logr/logr"
+	"golang.org/x/sync/semaphore"
 	admissionv1 "k8s.io/api/admission/v1"
+	authenticationv1 "k8s.io/api/authentication/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/metadata"
+	"k8s.io/client-go/rest"
+	"sigs.k8s.io/controller-runtime/pkg/cache"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 	"sigs.k8s.io/controller-runtime/pkg/client/apiutil"
+	logf "sigs.k8s.io/controller-runtime/pkg/log"
 	"sigs.k8s.io/controller-runtime/pkg/manager"
+	"sigs.k8s.io/controller-runtime/pkg/webhook"
 	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
 )
 
+var systemNamespaces = []string{
+	"kube-system",
+	"kube-public",
+	"kube-node-lease",
+}
+
 var ErrThereCanBeOnlyOne = errors.New(
 	"there can be only one instance of this object per namespace")
 
+var ErrPolicyViolated = errors.New("policy violated")
+
+var ErrLimitExceeded = errors.New("instance limit exceeded")
+
+// ConflictError is returned by ValidateCreate when the incoming object
+// conflicts with existing instances. It wraps ErrThereCanBeOnlyOne,
+// ErrPolicyViolated, or ErrLimitExceeded.
+type ConflictError struct {
+	Err error
+	// Conflicts contains the names of the conflicting instances, if known.
+	Conflicts []string
+}
+
+func (e *ConflictError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *ConflictError) Unwrap() error {
+	return e.Err
+}
+
+func newConflictError(err error, conflicts []unstructured.Unstructured) *ConflictError {
+	names := make([]string, 0, len(conflicts))
+	for _, item := range conflicts {
+		names = append(names, item.GetName())
+	}
+	return &ConflictError{
+		Err:       err,
+		Conflicts: names,
+	}
+}
+
+var ErrScopeImmutable = errors.New(
+	"the fields defining the scope of this object cannot be changed")
+
+var ErrDrained = errors.New(
+	"creation of this object is temporarily disabled for maintenance")
+
+var ErrNamespaceRequired = errors.New(
+	"namespaced object must have a namespace")
+
 type Webhook struct {
 	object client.Object
 	log    logr.Logger
 	gvk    schema.GroupVersionKind
 	mgr    manager.Manager
 	cli    client.Client
+
+	restConfig *rest.Config
+	apiReader  client.Reader
+
+	namespaced bool
+	gvr        schema.GroupVersionResource
+	informer   informers.GenericInformer
+	sem        *semaphore.Weighted
+	nameRegexp *regexp.Regexp
+	drained    int32
+	pauses     pauses
+
+	// runtimeScheme is the scheme resolved when the webhook is set up
+	runtimeScheme *runtime.Scheme
+
+	middleware                []func(admission.Handler) admission.Handler
+	exemptFieldManagers       []string
+	exemptUsers               []string
+	exemptGroups              []string
+	scopeAnnotation           string
+	excludeSystemNamespaces   bool
+	requireNamespace          bool
+	maxConcurrent             int
+	namePattern               string
+	equivalentGVKs            []schema.GroupVersionKind
+	postListFilter            PostListFilter
+	immutableIdentity         bool
+	impersonate               bool
+	admittedAtAnnotation      bool
+	uniqueLabelKey            string
+	uniqueLabelValue          string
+	shardFunc                 ShardFunc
+	namespaceCountAnnotation  string
+	policies                  []namedPolicy
+	scopeField                []string
+	clusterWide               bool
+	skipTerminatingNamespaces bool
+	decisionLog               *decisionLog
+	decisionLogFormat         DecisionLogFormat
+	activeCondition           string
+	leaseNamespace            string
+	metadataClient            metadata.Interface
+	verdictAnnotation         bool
+	scopeByUser               bool
+	enforcementMode           EnforcementMode
+	enforcementEnvVar         string
+	countResources            []countSource
+	countTerminating          bool
+	perValueKey               string
+	perValueLimits            map[string]int
+	perValueDefault           int
+	confirmOnEmpty            bool
+	lockBackend               LockBackend
+	lockClusterName           string
+	lockTTL                   time.Duration
+	bypassSecret              []byte
+	waitForTerminating        time.Duration
+	ownerChainDepth           int
+	ownerChainRoot            schema.GroupVersionKind
+	ownerChainRequired        bool
+	decodeFailurePolicy       DecodeFailurePolicy
+	listPageSize              int64
+	duplicateAnnotation       bool
+	scopeNamespaceField       []string
+	nameEqualsScope           bool
+	recognizeReplacement      bool
+	createRateLimit           *createRateLimit
+	scheme                    *runtime.Scheme
+	fixedNamespace            string
 }
 
-func NewFor(apiType client.Object) *Webhook {
-	return &Webhook{
+func NewFor(apiType client.Object, opts ...Option) *Webhook {
+	w := &Webhook{
 		object: apiType,
 	}
+	for _, opt := range opts {
+		opt(w)
+	}
+	return w
 }
 
-func (w *Webhook) Handle(ctx context.Context, req admission.Request) admission.Response {
-	if req.Operation != admissionv1.Create {
+func (w *Webhook) Handle(ctx context.Context, req admission.Request) (resp admission.Response) {
+	defer w.recoverPanic(req, &resp)
+
+	switch req.Operation {
+	case admissionv1.Create, admissionv1.Update:
+	default:
 		return admission.Allowed("")
 	}
+	// Requests for any served version of the kind are checked. Listing
+	// returns all instances regardless of the version they are stored as,
+	// and the incoming object is converted to the same version if the
+	// scheme allows it.
 	gvk := req.Kind
 	if gvk.Group != w.gvk.Group ||
-		gvk.Version != w.gvk.Version ||
 		gvk.Kind != w.gvk.Kind {
 		return admission.Allowed("")
 	}
+	if w.EnforcementMode() == EnforcementOff {
+		return admission.Allowed("")
+	}
+	if req.Operation == admissionv1.Create && w.Drained() {
+		return w.deny(ctx, req, ErrDrained.Error(), nil)
+	}
+	if until, ok := w.pausedUntil(req.Namespace); ok && req.Operation == admissionv1.Create {
+		return admission.Allowed("").WithWarnings(fmt.Sprintf(
+			"enforcement is paused in namespace %q until %s",
+			req.Namespace, until.UTC().Format(time.RFC3339)))
+	}
+	if contains(w.exemptFieldManagers, req.UserInfo.Username) {
+		return admission.Allowed("")
+	}
+	if w.excludeSystemNamespaces && contains(systemNamespaces, req.Namespace) {
+		return admission.Allowed("")
+	}
 
-	if err := w.ValidateCreate(); err != nil {
-		if errors.Is(err, ErrThereCanBeOnlyOne) {
-			return admission.Denied(err.Error())
+	obj := &unstructured.Unstructured{}
+	if err := obj.UnmarshalJSON(req.Object.Raw); err != nil {
+		return w.decodeFailed(ctx, req, err)
+	}
+	obj = w.toWebhookVersion(obj)
+	if req.Operation == admissionv1.Update {
+		if resp, checkConflicts := w.handleUpdate(ctx, req, obj); !checkConflicts {
+			return resp
+		}
+	} else {
+		if w.scopeByUser {
+			// The mutating companion webhook stamps the same value, but it is
+			// set here as well in case it was not run or was bypassed
+			annotations := obj.GetAnnotations()
+			if annotations == nil {
+				annotations = map[string]string{}
+			}
+			annotations[CreatorAnnotation] = req.UserInfo.Username
+			obj.SetAnnotations(annotations)
+		}
+		if w.requireNamespace && w.namespaced && obj.GetNamespace() == "" {
+			return w.deny(ctx, req, ErrNamespaceRequired.Error(), nil)
+		}
+		if w.fixedNamespace != "" && w.namespaced && obj.GetNamespace() != w.fixedNamespace {
+			return w.deny(ctx, req, fmt.Sprintf(
+				"this object can only be created in the %q namespace", w.fixedNamespace), nil)
+		}
+		if w.nameRegexp != nil && !w.nameRegexp.MatchString(obj.GetName()) {
+			return w.deny(ctx, req, fmt.Sprintf(
+				"name %q does not match the required pattern %q",
+				obj.GetName(), w.namePattern), nil)
+		}
+		if w.nameEqualsScope {
+			key, err := w.scopeNameKey(obj)
+			if err != nil {
+				return admission.Errored(http.StatusBadRequest, err)
+			}
+			if key != "" && obj.GetName() != key {
+				return w.deny(ctx, req, fmt.Sprintf(
+					"name %q must be %q to match the scope of this object",
+					obj.GetName(), key), nil)
+			}
+		}
+	}
+
+	if w.skipTerminatingNamespaces && w.namespaced && obj.GetNamespace() != "" &&
+		w.namespaceTerminating(ctx, obj.GetNamespace()) {
+		// The API server will reject the create
+		return admission.Allowed("")
+	}
+
+	var reader client.Reader = w.cli
+	cached := true
+	if w.impersonate {
+		c, err := w.impersonatingClient(req.UserInfo)
+		if err != nil {
+			return admission.Errored(http.StatusInternalServerError, err)
+		}
+		reader = c
+		cached = false
+	}
+	warnings, err := w.validateCreate(ctx, obj, validateOptions{
+		reader:    reader,
+		cached:    cached,
+		dryRun:    req.DryRun != nil && *req.DryRun,
+		rateLimit: req.Operation == admissionv1.Create,
+	})
+	if err != nil {
+		var conflict *ConflictError
+		var limited *rateLimitError
+		if errors.As(err, &limited) {
+			return w.denyRateLimited(ctx, req, limited)
+		}
+		if errors.Is(err, ErrOwnerChainBroken) {
+			if req.Operation == admissionv1.Update {
+				return admission.Allowed("").WithWarnings(
+					"allowed without checking the scope of this object: " + err.Error())
+			}
+			return w.deny(ctx, req, err.Error(), nil)
+		}
+		if errors.As(err, &conflict) {
+			if w.isExempt(req.UserInfo.Username, req.UserInfo.Groups) {
+				w.log.Info("Exempt user bypassed singleton restriction",
+					"username", req.UserInfo.Username,
+					"namespace", req.Namespace,
+					"name", req.Name,
+				)
+				w.logDecision(ctx, req, DecisionBypassed, err.Error(), conflict.Conflicts)
+				return admission.Allowed("").WithWarnings(
+					"user " + req.UserInfo.Username + " is exempt: " + err.Error())
+			}
+			if len(w.bypassSecret) > 0 {
+				if ok, tokenErr := w.verifyBypassToken(obj); ok {
+					if tokenErr != nil {
+						return w.deny(ctx, req, fmt.Sprintf("%s (%s)", err.Error(), tokenErr.Error()),
+							conflict.Conflicts)
+					}
+					w.log.Info("Bypass token allowed singleton restriction to be bypassed",
+						"username", req.UserInfo.Username,
+						"namespace", req.Namespace,
+						"name", req.Name,
+					)
+					w.logDecision(ctx, req, DecisionBypassed, err.Error(), conflict.Conflicts)
+					return admission.Allowed("").WithWarnings(
+						"allowed by bypass token: " + err.Error())
+				}
+			}
+			if w.duplicateAnnotation {
+				// Duplicates are annotated by the mutating companion webhook
+				w.logDecision(ctx, req, DecisionAdvisory, err.Error(), conflict.Conflicts)
+				return admission.Allowed("").WithWarnings("duplicate: " + err.Error())
+			}
+			return w.deny(ctx, req, err.Error(), conflict.Conflicts)
 		} else {
 			return admission.Errored(http.StatusBadRequest, err)
 		}
 	}
 
-	return admission.Allowed("")
+	return admission.Allowed("").WithWarnings(warnings...)
+}
+
+// denyRateLimited denies a create which exceeded the limit set with
+// WithCreateRateLimit, with a hint of when to retry.
+func (w *Webhook) denyRateLimited(
+	ctx context.Context,
+	req admission.Request,
+	err *rateLimitError,
+) admission.Response {
+	seconds := int32(math.Ceil(err.retryAfter.Seconds()))
+	resp := w.deny(ctx, req, fmt.Sprintf("%s, retry after %ds", err.Error(), seconds), nil)
+	if !resp.Allowed && resp.Result != nil {
+		resp.Result.Details = &metav1.StatusDetails{RetryAfterSeconds: seconds}
+	}
+	return resp
+}
+
+// decodeFailed returns the response for a request whose object could not be
+// decoded, according to the configured DecodeFailurePolicy.
+func (w *Webhook) decodeFailed(
+	ctx context.Context,
+	req admission.Request,
+	err error,
+) admission.Response {
+	w.log.Error(err, "Failed to decode object",
+		"namespace", req.Namespace,
+		"name", req.Name,
+		"length", len(req.Object.Raw),
+		"contentType", http.DetectContentType(req.Object.Raw),
+		"policy", w.decodeFailurePolicy,
+	)
+	switch w.decodeFailurePolicy {
+	case DecodeFailureAllow:
+		return admission.Allowed("").WithWarnings(
+			"allowed without checking for other instances: " + err.Error())
+	case DecodeFailureDeny:
+		return w.deny(ctx, req, "failed to decode object: "+err.Error(), nil)
+	default:
+		return admission.Errored(http.StatusBadRequest, err)
+	}
+}
+
+// recoverPanic recovers from a panic while handling the request, such as
+// one raised by a user-provided callback, and replaces the response with an
+// error.
+func (w *Webhook) recoverPanic(req admission.Request, resp *admission.Response) {
+	if r := recover(); r != nil {
+		err := fmt.Errorf("panic while handling request: %v", r)
+		w.log.Error(err, "Recovered from panic",
+			"namespace", req.Namespace,
+			"name", req.Name,
+		)
+		*resp = admission.Errored(http.StatusInternalServerError, err)
+	}
+}
+
+// handleUpdate validates an update to an existing object. If the update
+// should be checked for conflicts in the same way as a create, because it
+// moves the object into a different scope or adds the unique label value,
+// it returns true. Otherwise, the returned response should be used.
+func (w *Webhook) handleUpdate(
+	ctx context.Context,
+	req admission.Request,
+	obj *unstructured.Unstructured,
+) (admission.Response, bool) {
+	oldObj := &unstructured.Unstructured{}
+	if err := oldObj.UnmarshalJSON(req.OldObject.Raw); err != nil {
+		return admission.Errored(http.StatusBadRequest, err), false
+	}
+	oldObj = w.toWebhookVersion(oldObj)
+	if obj.GetDeletionTimestamp() != nil {
+		// Objects being deleted must always be updatable, for example to
+		// remove their finalizers
+		return admission.Allowed(""), false
+	}
+	oldScope, err := w.scopeOf(ctx, oldObj)
+	if err == nil {
+		var scope string
+		scope, err = w.scopeOf(ctx, obj)
+		if err != nil && !errors.Is(err, ErrOwnerChainBroken) {
+			return admission.Errored(http.StatusBadRequest, err), false
+		}
+		if err == nil && scope != oldScope {
+			if w.immutableIdentity {
+				return w.deny(ctx, req, ErrScopeImmutable.Error(), nil), false
+			}
+			// The object is moving to a different scope, which must not
+			// already have an instance
+			return admission.Response{}, true
+		}
+	}
+	if err != nil {
+		// The existing object must stay updatable, for example to fix the
+		// value its scope could not be computed from. The owner may also
+		// have been deleted, and the garbage collector must be able to
+		// remove the owner reference.
+		return admission.Allowed("").WithWarnings(
+			"allowed without checking the scope of this object: " + err.Error()), false
+	}
+	if w.hasUniqueLabel(obj) && !w.hasUniqueLabel(oldObj) {
+		// Adding the unique label to an existing object is treated as if the
+		// object was being created
+		return admission.Response{}, true
+	}
+	return admission.Allowed(""), false
+}
+
+// SetDrain enables or disables drain mode. While drained, all creates of the
+// guarded kind are denied, regardless of any existing instances. This can
+// be toggled at any time while the webhook is running.
+func (w *Webhook) SetDrain(drain bool) {
+	var v int32
+	if drain {
+		v = 1
+	}
+	atomic.StoreInt32(&w.drained, v)
+}
+
+// Drained returns whether the webhook is in drain mode.
+func (w *Webhook) Drained() bool {
+	return atomic.LoadInt32(&w.drained) == 1
+}
+
+func (w *Webhook) isExempt(username string, groups []string) bool {
+	if contains(w.exemptUsers, username) {
+		return true
+	}
+	for _, group := range groups {
+		if contains(w.exemptGroups, group) {
+			return true
+		}
+	}
+	return false
+}
+
+// impersonatingClient returns a client which makes requests as the given
+// user. It does not use the manager's cache.
+func (w *Webhook) impersonatingClient(user authenticationv1.UserInfo) (client.Client, error) {
+	extra := make(map[string][]string, len(user.Extra))
+	for k, v := range user.Extra {
+		extra[k] = v
+	}
+	cfg := rest.CopyConfig(w.restConfig)
+	cfg.Impersonate = rest.ImpersonationConfig{
+		UserName: user.Username,
+		Groups:   user.Groups,
+		Extra:    extra,
+	}
+	return client.New(cfg, client.Options{
+		Scheme: w.cli.Scheme(),
+		Mapper: w.cli.RESTMapper(),
+	})
 }
 
 func (w *Webhook) SetupWithManager(mgr manager.Manager) error {
 	w.mgr = mgr
-	w.cli = mgr.GetClient()
 	w.log = mgr.GetLogger()
+	w.restConfig = mgr.GetConfig()
+	w.apiReader = mgr.GetAPIReader()
+	if err := w.SetupWithServer(mgr.GetWebhookServer(), mgr.GetScheme(), mgr.GetClient()); err != nil {
+		return err
+	}
+	if w.informer != nil || w.lockBackend != nil {
+		return mgr.Add(w)
+	}
+	return nil
+}
+
+// SetupWithServer registers the webhook on the given server without
+// requiring a manager. The client is used to list existing instances, and
+// its RESTMapper is used to determine whether the object is namespaced.
+func (w *Webhook) SetupWithServer(
+	server *webhook.Server,
+	scheme *runtime.Scheme,
+	c client.Client,
+) error {
+	w.cli = c
+	if w.scheme != nil {
+		scheme = w.scheme
+	}
+	w.runtimeScheme = scheme
+	if w.log == nil {
+		w.log = logf.Log.WithName("highlander")
+	}
+	if w.impersonate && w.restConfig == nil {
+		return errors.New("impersonation requires setting up the webhook with a manager")
+	}
+	if w.perValueKey != "" && len(w.policies) == 0 && (w.leaseNamespace != "" || w.lockBackend != nil) {
+		return errors.New("WithPerValueMax cannot be combined with WithLease or WithLockBackend")
+	}
+	if w.nameEqualsScope && (w.scopeByUser || w.ownerChainDepth > 0 || w.shardFunc != nil) {
+		return errors.New("WithNameEqualsScope cannot be combined with WithScopeByUser, " +
+			"WithOwnerChainScope or WithShardFunc")
+	}
+	if w.decisionLog != nil {
+		if err := w.decisionLog.open(); err != nil {
+			return fmt.Errorf("failed to open decision log: %w", err)
+		}
+	}
 
 	var err error
-	w.gvk, err = apiutil.GVKForObject(w.object, mgr.GetScheme())
+	w.gvk, err = apiutil.GVKForObject(w.object, scheme)
 	if err != nil {
 		return err
 	}
 
+	var handler admission.Handler = w
+	for _, mw := range w.middleware {
+		handler = mw(handler)
+	}
+
+	mapping, err := c.RESTMapper().RESTMapping(w.gvk.GroupKind(), w.gvk.Version)
+	if err != nil {
+		return err
+	}
+	w.namespaced = mapping.Scope.Name() == meta.RESTScopeNameNamespace
+	w.gvr = mapping.Resource
+	if w.metadataClient != nil {
+		w.setupInformer()
+	}
+
+	if w.namePattern != "" {
+		w.nameRegexp, err = regexp.Compile(w.namePattern)
+		if err != nil {
+			return fmt.Errorf("invalid name pattern: %w", err)
+		}
+	}
+
 	path := generateValidatePath(w.gvk)
 	wh := &admission.Webhook{
-		Handler: w,
+		Handler: handler,
 	}
 	wh.InjectLogger(w.log)
-	wh.InjectScheme(mgr.GetScheme())
-	mgr.GetWebhookServer().Register(path, wh)
+	wh.InjectScheme(scheme)
+	server.Register(path, wh)
+
+	if w.mutating() {
+		mwh := &admission.Webhook{
+			Handler: &mutator{w: w},
+		}
+		mwh.InjectLogger(w.log)
+		mwh.InjectScheme(scheme)
+		server.Register(generateMutatePath(w.gvk), mwh)
+	}
 	return nil
 }
 
-func (w *Webhook) ValidateCreate() error {
-	// Check if any other instances of this gvk exist in the same namespace
-	ul := unstructured.UnstructuredList{}
-	ul.SetGroupVersionKind(w.gvk)
-	err := w.cli.List(context.Background(), &ul, &client.ListOptions{
-		Namespace: w.object.GetNamespace(),
-	})
+// ValidateCreate checks whether the object can be created without
+// conflicting with existing instances, and returns any warnings to attach to
+// the create. Conflicts are returned as a *ConflictError.
+//
+// This signature replaces ValidateCreate() error, which checked the
+// namespace of the object passed to NewFor. Callers of the old method should
+// pass the object being created, as an *unstructured.Unstructured, and may
+// ignore the warnings.
+func (w *Webhook) ValidateCreate(
+	ctx context.Context,
+	obj *unstructured.Unstructured,
+) (warnings []string, err error) {
+	return w.validateCreate(ctx, obj, validateOptions{reader: w.cli, cached: true})
+}
+
+type validateOptions struct {
+	// reader is used to read the existing instances.
+	reader client.Reader
+	// cached is true if reader is the webhook's client, which is backed by
+	// the manager's cache when set up with a manager.
+	cached bool
+	// dryRun skips any side effects of the check, such as acquiring a lease.
+	dryRun bool
+	// pending contains objects which do not exist yet, but should be counted
+	// as existing instances.
+	pending []unstructured.Unstructured
+	// rateLimit checks the create against the limit set with
+	// WithCreateRateLimit, and counts it unless it is a dry run.
+	rateLimit bool
+}
+
+// validateCreate checks the incoming object against the existing instances.
+func (w *Webhook) validateCreate(
+	ctx context.Context,
+	obj *unstructured.Unstructured,
+	opts validateOptions,
+) (warnings []string, err error) {
+	obj = w.toWebhookVersion(obj)
+	uniqueLabel := w.uniqueLabelKey != "" && len(w.policies) == 0
+	if uniqueLabel && !w.hasUniqueLabel(obj) {
+		// Only objects with the unique label value are restricted
+		return nil, nil
+	}
+	scope, err := w.scopeOf(ctx, obj)
+	if errors.Is(err, ErrOwnerChainBroken) && !w.ownerChainRequired {
+		return []string{fmt.Sprintf("allowed without checking for other instances: %v", err)}, nil
+	}
 	if err != nil {
-		w.log.Error(err, "Failed to list objects in namespace",
-			"namespace", w.object.GetNamespace(),
+		return nil, err
+	}
+
+	counted := false
+	if w.namespaceCountUsable(opts) {
+		count, ok := w.namespaceCount(ctx, opts.reader, obj.GetNamespace())
+		if ok && count > 0 {
+			return nil, &ConflictError{Err: ErrThereCanBeOnlyOne}
+		}
+		counted = ok
+	}
+	if !counted {
+		warnings, err = w.checkExisting(ctx, obj, scope, uniqueLabel, opts)
+		if err != nil {
+			return nil, err
+		}
+	}
+	// The create is counted toward the rate limit before acquiring the lease
+	// or lock, so that they are not acquired for a create which is denied
+	release := func() {}
+	if opts.rateLimit && w.createRateLimit != nil {
+		now := time.Now()
+		ok, retryAfter := w.createRateLimit.allow(scope, now, !opts.dryRun)
+		if !ok {
+			return nil, &rateLimitError{limit: w.createRateLimit, retryAfter: retryAfter}
+		}
+		if !opts.dryRun {
+			release = func() { w.createRateLimit.cancel(scope, now) }
+		}
+	}
+	if len(w.policies) > 0 || w.perValueKey != "" {
+		return warnings, nil
+	}
+
+	if w.leaseNamespace != "" && !opts.dryRun {
+		if err := w.acquireLease(ctx, obj, scope); err != nil {
+			release()
+			return nil, err
+		}
+		cancel := release
+		release = func() {
+			cancel()
+			w.releaseLease(ctx, obj, scope)
+		}
+	}
+	if w.lockBackend != nil {
+		if err := w.acquireLock(ctx, obj, opts.dryRun); err != nil {
+			release()
+			return nil, err
+		}
+	}
+	return warnings, nil
+}
+
+// namespaceCountUsable returns whether the number of existing instances can
+// be read from the annotation configured with WithNamespaceCountAnnotation.
+// The annotation counts every instance in the namespace, so it cannot be
+// used with any option which divides the namespace into smaller scopes or
+// changes which instances are counted.
+func (w *Webhook) namespaceCountUsable(opts validateOptions) bool {
+	return w.namespaceCountAnnotation != "" && w.namespaced && !w.clusterWide &&
+		len(opts.pending) == 0 &&
+		len(w.scopeField) == 0 && len(w.scopeNamespaceField) == 0 &&
+		w.shardFunc == nil && !w.scopeByUser && w.ownerChainDepth == 0 &&
+		w.uniqueLabelKey == "" && w.activeCondition == "" &&
+		len(w.countResources) == 0 && w.postListFilter == nil &&
+		!w.recognizeReplacement && len(w.policies) == 0 && w.perValueKey == ""
+}
+
+// checkExisting lists the existing instances in the incoming object's scope
+// and returns an error if creating the object would conflict with them.
+func (w *Webhook) checkExisting(
+	ctx context.Context,
+	obj *unstructured.Unstructured,
+	scope string,
+	uniqueLabel bool,
+	opts validateOptions,
+) (warnings []string, err error) {
+	reader := opts.reader
+
+	// Whether each listed item is counted is remembered, since computing it
+	// may need to look up the item's owners
+	type itemKey struct {
+		gk        schema.GroupKind
+		namespace string
+		name      string
+	}
+	type countResult struct {
+		counted bool
+		warning string
+	}
+	results := map[itemKey]countResult{}
+	counts := func(item *unstructured.Unstructured) (bool, string) {
+		if item.GetName() == "" {
+			return w.counts(ctx, obj, item, scope, uniqueLabel)
+		}
+		key := itemKey{
+			gk:        item.GroupVersionKind().GroupKind(),
+			namespace: item.GetNamespace(),
+			name:      item.GetName(),
+		}
+		if result, ok := results[key]; ok {
+			return result.counted, result.warning
+		}
+		counted, warning := w.counts(ctx, obj, item, scope, uniqueLabel)
+		results[key] = countResult{counted: counted, warning: warning}
+		return counted, warning
+	}
+
+	// Once a conflicting instance is found, the rest need not be listed,
+	// unless all instances are needed to decide
+	var stop func(page []unstructured.Unstructured) bool
+	if w.postListFilter == nil && len(w.policies) == 0 && w.perValueKey == "" &&
+		w.waitForTerminating == 0 {
+		stop = func(page []unstructured.Unstructured) bool {
+			for i := range page {
+				if counted, _ := counts(&page[i]); counted {
+					return true
+				}
+			}
+			return false
+		}
+	}
+
+	// Check if any other instances of this gvk exist in the same scope
+	listOpts, err := w.ComputeListOptions(obj)
+	if err != nil {
+		return nil, err
+	}
+	items, err := w.listInstances(ctx, reader, opts.cached, listOpts, stop)
+	if err != nil {
+		return nil, err
+	}
+	if len(items) == 0 && w.confirmOnEmpty && opts.cached && w.apiReader != nil {
+		// The cache may be stale, confirm with a live read
+		items, err = w.listInstances(ctx, w.apiReader, false, listOpts, stop)
+		if err != nil {
+			return nil, err
+		}
+		if len(items) > 0 {
+			w.log.Info("Found instances missing from the cache",
+				"namespace", listOpts.Namespace,
+				"count", len(items),
+			)
+		}
+	}
+	items = append(items, opts.pending...)
+	if w.postListFilter != nil {
+		items = w.postListFilter(items, obj)
+	}
+	var existing []unstructured.Unstructured
+	for i := range items {
+		counted, warning := counts(&items[i])
+		if warning != "" {
+			warnings = append(warnings, warning)
+		}
+		if counted {
+			existing = append(existing, items[i])
+		}
+	}
+
+	if w.waitForTerminating > 0 && len(existing) > 0 && allTerminating(existing) {
+		if w.waitForDeletion(ctx, existing) {
+			existing = nil
+		}
+	}
+
+	if len(w.policies) > 0 {
+		if err := w.checkPolicies(obj, existing); err != nil {
+			return nil, err
+		}
+		return warnings, nil
+	}
+	if w.perValueKey != "" {
+		if err := w.checkPerValueMax(obj, existing); err != nil {
+			return nil, err
+		}
+		return warnings, nil
+	}
+	if len(existing) > 0 {
+		if uniqueLabel {
+			return nil, newConflictError(fmt.Errorf("%w with label %s=%s",
+				ErrThereCanBeOnlyOne, w.uniqueLabelKey, w.uniqueLabelValue), existing)
+		}
+		return nil, newConflictError(ErrThereCanBeOnlyOne, existing)
+	}
+	return warnings, nil
+}
+
+// counts returns whether the existing item counts as another instance in the
+// incoming object's scope, and a warning if it was not counted for a reason
+// the user should know about.
+func (w *Webhook) counts(
+	ctx context.Context,
+	obj *unstructured.Unstructured,
+	item *unstructured.Unstructured,
+	scope string,
+	uniqueLabel bool,
+) (bool, string) {
+	itemScope, err := w.scopeOf(ctx, item)
+	if err != nil {
+		w.log.Error(err, "Failed to compute scope of existing object, ignoring",
+			"namespace", item.GetNamespace(),
+			"name", item.GetName(),
 		)
-		return err
+		return false, ""
+	}
+	if itemScope != scope {
+		return false, ""
+	}
+	if isSameObject(obj, item) {
+		return false, ""
+	}
+	if uniqueLabel && !w.hasUniqueLabel(item) {
+		return false, ""
+	}
+	if w.activeCondition != "" && !hasTrueCondition(item, w.activeCondition) {
+		// Instances which are not active can be replaced
+		return false, ""
 	}
-	if len(ul.Items) > 0 {
-		if ul.Items[0].GetDeletionTimestamp() != nil {
-			// Old object is being deleted, allow the new one to be created
-			return nil
+	if w.recognizeReplacement && isReplacement(obj, item) {
+		return false, fmt.Sprintf(
+			"allowed as a replacement for existing instance %q", item.GetName())
+	}
+	if item.GetDeletionTimestamp() != nil && !w.countTerminating {
+		// Old object is being deleted, allow the new one to be created
+		return false, fmt.Sprintf(
+			"allowed because existing instance %q is terminating", item.GetName())
+	}
+	return true, ""
+}
+
+// checkPolicies returns an error if creating the object would violate any of
+// the configured policies, given the existing instances in its scope.
+func (w *Webhook) checkPolicies(
+	obj *unstructured.Unstructured,
+	existing []unstructured.Unstructured,
+) error {
+	for _, p := range w.policies {
+		if !p.matches(obj) {
+			continue
+		}
+		var matching []unstructured.Unstructured
+		for _, item := range existing {
+			if p.matches(&item) {
+				matching = append(matching, item)
+			}
+		}
+		if len(matching) >= p.max() {
+			return newConflictError(fmt.Errorf(
+				"%w: %q allows at most %d matching instance(s) per scope",
+				ErrPolicyViolated, p.name, p.max()), matching)
 		}
-		return ErrThereCanBeOnlyOne
 	}
 	return nil
 }
 
+// hasTrueCondition returns whether the object has a condition of the given
+// type in status.conditions with a status of "True".
+func hasTrueCondition(obj *unstructured.Unstructured, conditionType string) bool {
+	conditions, _, _ := unstructured.NestedSlice(obj.Object, "status", "conditions")
+	for _, c := range conditions {
+		condition, ok := c.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		if condition["type"] == conditionType && condition["status"] == "True" {
+			return true
+		}
+	}
+	return false
+}
+
+// checkPerValueMax returns an error if creating the object would exceed the
+// limit for the value of its label configured with WithPerValueMax.
+func (w *Webhook) checkPerValueMax(
+	obj *unstructured.Unstructured,
+	existing []unstructured.Unstructured,
+) error {
+	value := obj.GetLabels()[w.perValueKey]
+	limit, ok := w.perValueLimits[value]
+	if !ok {
+		limit = w.perValueDefault
+	}
+	var matching []unstructured.Unstructured
+	for _, item := range existing {
+		if item.GetLabels()[w.perValueKey] == value {
+			matching = append(matching, item)
+		}
+	}
+	if len(matching) >= limit {
+		return newConflictError(fmt.Errorf(
+			"%w: at most %d instance(s) with label %s=%s are allowed per scope",
+			ErrLimitExceeded, limit, w.perValueKey, value), matching)
+	}
+	return nil
+}
+
+// isSameObject returns whether the existing item is the incoming object
+// itself. This is the case for updates, and also for creates of an object
+// which already exists with the same name, such as when restoring from a
+// backup. The latter are not counted as conflicts so that the API server can
+// reject them as AlreadyExists, or accept them if the existing object is
+// deleted first. Note that the API server assigns a new UID to every create
+// before admission, so a UID carried by a restored object never matches.
+func isSameObject(obj, item *unstructured.Unstructured) bool {
+	if obj.GetUID() != "" && obj.GetUID() == item.GetUID() {
+		return true
+	}
+	return obj.GetName() != "" &&
+		obj.GetName() == item.GetName() &&
+		obj.GetNamespace() == item.GetNamespace() &&
+		obj.GroupVersionKind().GroupKind() == item.GroupVersionKind().GroupKind()
+}
+
+func (w *Webhook) hasUniqueLabel(obj *unstructured.Unstructured) bool {
+	if w.uniqueLabelKey == "" {
+		return false
+	}
+	value, ok := obj.GetLabels()[w.uniqueLabelKey]
+	return ok && value == w.uniqueLabelValue
+}
+
+// countSource is a kind of object counted as existing instances.
+type countSource struct {
+	gvk        schema.GroupVersionKind
+	namePrefix string
+	// optional sources are ignored if the kind is not served
+	optional bool
+}
+
+// countSources returns the kinds of objects counted as existing instances.
+// These are the webhook's gvk and any equivalent gvks, unless other
+// resources were configured with WithCountResource.
+func (w *Webhook) countSources() []countSource {
+	if len(w.countResources) > 0 {
+		return w.countResources
+	}
+	sources := []countSource{{gvk: w.gvk}}
+	for _, gvk := range w.equivalentGVKs {
+		sources = append(sources, countSource{gvk: gvk, optional: true})
+	}
+	return sources
+}
+
+// ComputeListOptions returns the options used to list existing instances
+// when checking the incoming object. Only the namespace is selected by the
+// API server; the other options which define an instance's scope, such as
+// label values and scope fields, are applied to the listed objects. The
+// limit is set by WithListPageSize. The webhook must already be set up.
+func (w *Webhook) ComputeListOptions(incoming *unstructured.Unstructured) (*client.ListOptions, error) {
+	if gk := incoming.GroupVersionKind().GroupKind(); !gk.Empty() && gk != w.gvk.GroupKind() {
+		return nil, fmt.Errorf("%s is not checked by this webhook", gk.String())
+	}
+	opts := &client.ListOptions{
+		Namespace: incoming.GetNamespace(),
+		Limit:     w.listPageSize,
+	}
+	if w.clusterWide || len(w.scopeNamespaceField) > 0 {
+		opts.Namespace = ""
+	}
+	return opts, nil
+}
+
+// listInstances lists all objects counted as existing instances using the
+// given list options. If cached is true, the reader is the webhook's client,
+// and the metadata informer and the API reader fallback can be used instead.
+// If stop is not nil, it is called with each page of objects as they are
+// listed, and listing ends early if it returns true.
+func (w *Webhook) listInstances(
+	ctx context.Context,
+	reader client.Reader,
+	cached bool,
+	listOpts *client.ListOptions,
+	stop func(page []unstructured.Unstructured) bool,
+) ([]unstructured.Unstructured, error) {
+	if w.sem != nil {
+		// Wait until the request's deadline for another list to finish
+		if err := w.sem.Acquire(ctx, 1); err != nil {
+			w.log.Error(err, "Timed out waiting for in-flight list calls")
+			return nil, err
+		}
+		defer w.sem.Release(1)
+	}
+	namespace := listOpts.Namespace
+	var items []unstructured.Unstructured
+sources:
+	for _, source := range w.countSources() {
+		gvk := source.gvk
+		if gvk == w.gvk && cached {
+			informerItems, ok, err := w.listFromInformer(namespace)
+			if err != nil {
+				return nil, err
+			}
+			if ok {
+				items = append(items, informerItems...)
+				if stop != nil && stop(informerItems) {
+					return items, nil
+				}
+				continue
+			}
+		}
+		opts := *listOpts
+		r := reader
+		fromCache := cached
+		sourceStart := len(items)
+		for {
+			ul := unstructured.UnstructuredList{}
+			ul.SetGroupVersionKind(gvk)
+			err := r.List(ctx, &ul, &opts)
+			var notStarted *cache.ErrCacheNotStarted
+			if errors.As(err, &notStarted) && fromCache && w.apiReader != nil {
+				w.log.Info("Cache not started, listing objects from the API server",
+					"namespace", namespace,
+					"gvk", gvk.String(),
+				)
+				cacheFallbackTotal.WithLabelValues(gvk.String()).Inc()
+				r = w.apiReader
+				fromCache = false
+				continue
+			}
+			if err != nil {
+				if source.optional && meta.IsNoMatchError(err) {
+					// The equivalent kind is no longer served, nothing to count
+					continue sources
+				}
+				if apierrors.IsForbidden(err) {
+					w.log.Error(err, "Forbidden from listing objects, check the webhook's RBAC permissions",
+						"namespace", namespace,
+						"gvk", gvk.String(),
+					)
+					rbacForbiddenTotal.WithLabelValues(gvk.String()).Inc()
+					return nil, fmt.Errorf("webhook is not allowed to list %s, "+
+						"its RBAC permissions may be misconfigured: %w", gvk.String(), err)
+				}
+				w.log.Error(err, "Failed to list objects in namespace",
+					"namespace", namespace,
+					"gvk", gvk.String(),
+				)
+				return nil, err
+			}
+			var page []unstructured.Unstructured
+			for _, item := range ul.Items {
+				if strings.HasPrefix(item.GetName(), source.namePrefix) {
+					page = append(page, item)
+				}
+			}
+			items = append(items, page...)
+			if stop != nil && stop(page) {
+				return items, nil
+			}
+			if ul.GetContinue() == "" && opts.Limit > 0 && int64(len(ul.Items)) >= opts.Limit {
+				// A cache truncates lists to the limit without returning a
+				// continue token, so a full last page may be incomplete.
+				// List everything again without a limit.
+				items = items[:sourceStart]
+				opts.Limit = 0
+				opts.Continue = ""
+				continue
+			}
+			if ul.GetContinue() == "" {
+				break
+			}
+			opts.Continue = ul.GetContinue()
+		}
+	}
+	return items, nil
+}
+
+// waitForTerminatingInterval is how often terminating instances are checked
+// while waiting for them to be deleted.
+const waitForTerminatingInterval = 500 * time.Millisecond
+
+func allTerminating(items []unstructured.Unstructured) bool {
+	for _, item := range items {
+		if item.GetDeletionTimestamp() == nil {
+			return false
+		}
+	}
+	return true
+}
+
+// waitForDeletion polls the API server until the given objects no longer
+// exist, returning false if any still exist after the duration configured
+// with WithWaitForTerminating.
+func (w *Webhook) waitForDeletion(ctx context.Context, items []unstructured.Unstructured) bool {
+	ctx, cancel := context.WithTimeout(ctx, w.waitForTerminating)
+	defer cancel()
+	var reader client.Reader = w.cli
+	if w.apiReader != nil {
+		reader = w.apiReader
+	}
+	err := wait.PollImmediateUntil(waitForTerminatingInterval, func() (bool, error) {
+		for _, item := range items {
+			current := &unstructured.Unstructured{}
+			current.SetGroupVersionKind(item.GroupVersionKind())
+			err := reader.Get(ctx, client.ObjectKeyFromObject(&item), current)
+			if apierrors.IsNotFound(err) {
+				continue
+			}
+			if err != nil {
+				return false, err
+			}
+			if current.GetUID() != item.GetUID() {
+				// The object was deleted and a new one created in its place
+				continue
+			}
+			return false, nil
+		}
+		return true, nil
+	}, ctx.Done())
+	if err != nil {
+		w.log.Info("Terminating instances still exist",
+			"count", len(items),
+			"error", err.Error(),
+		)
+		return false
+	}
+	return true
+}
+
+// namespaceTerminating returns whether the namespace is being deleted. The
+// namespace is read using the webhook's client, which is backed by the
+// manager's cache when set up with a manager.
+func (w *Webhook) namespaceTerminating(ctx context.Context, namespace string) bool {
+	ns := &corev1.Namespace{}
+	if err := w.cli.Get(ctx, client.ObjectKey{Name: namespace}, ns); err != nil {
+		w.log.Error(err, "Failed to get namespace",
+			"namespace", namespace,
+		)
+		return false
+	}
+	return ns.GetDeletionTimestamp() != nil || ns.Status.Phase == corev1.NamespaceTerminating
+}
+
+// namespaceCount reads the number of existing instances from the annotation
+// configured with WithNamespaceCountAnnotation. If the namespace cannot be
+// read or the annotation is missing or invalid, it returns false.
+func (w *Webhook) namespaceCount(
+	ctx context.Context,
+	reader client.Reader,
+	namespace string,
+) (int, bool) {
+	ns := &corev1.Namespace{}
+	if err := reader.Get(ctx, client.ObjectKey{Name: namespace}, ns); err != nil {
+		w.log.Error(err, "Failed to get namespace, listing objects instead",
+			"namespace", namespace,
+		)
+		return 0, false
+	}
+	value, ok := ns.GetAnnotations()[w.namespaceCountAnnotation]
+	if !ok {
+		return 0, false
+	}
+	count, err := strconv.Atoi(value)
+	if err != nil || count < 0 {
+		w.log.Info("Invalid instance count annotation, listing objects instead",
+			"namespace", namespace,
+			"annotation", w.namespaceCountAnnotation,
+			"value", value,
+		)
+		return 0, false
+	}
+	return count, true
+}
+
+// scopeOf returns the key identifying the group of objects within which
+// only one instance is allowed to exist.
+func (w *Webhook) scopeOf(ctx context.Context, obj *unstructured.Unstructured) (string, error) {
+	scope, err := w.scopeNamespaceOf(obj)
+	if err != nil {
+		return "", err
+	}
+	if len(w.scopeField) > 0 {
+		value, err := w.scopeFieldOf(obj)
+		if err != nil {
+			return "", err
+		}
+		scope += "/" + value
+	}
+	if w.scopeByUser {
+		scope += "/" + obj.GetAnnotations()[CreatorAnnotation]
+	}
+	if w.ownerChainDepth > 0 {
+		root, err := w.ownerChainRootOf(ctx, obj)
+		if err != nil {
+			return "", err
+		}
+		scope += "/" + root
+	}
+	if w.shardFunc != nil {
+		shard, err := w.shardFunc(obj)
+		if err != nil {
+			return "", fmt.Errorf("failed to compute shard: %w", err)
+		}
+		scope += "/" + shard
+	}
+	return scope, nil
+}
+
+// scopeNamespaceOf returns the namespace-like part of the object's scope
+// key: its namespace, scope annotation or scope namespace field, or "" if
+// the scope is cluster-wide.
+func (w *Webhook) scopeNamespaceOf(obj *unstructured.Unstructured) (string, error) {
+	scope := obj.GetNamespace()
+	if w.clusterWide {
+		scope = ""
+	}
+	if !w.namespaced && w.scopeAnnotation != "" {
+		scope = obj.GetAnnotations()[w.scopeAnnotation]
+	}
+	if len(w.scopeNamespaceField) > 0 {
+		value, found, err := unstructured.NestedString(obj.Object, w.scopeNamespaceField...)
+		if err != nil {
+			return "", fmt.Errorf("failed to read scope namespace field: %w", err)
+		}
+		if found && value != "" {
+			scope = value
+		}
+	}
+	return scope, nil
+}
+
+// scopeFieldOf returns the value of the field set with WithScopeField.
+func (w *Webhook) scopeFieldOf(obj *unstructured.Unstructured) (string, error) {
+	value, _, err := unstructured.NestedString(obj.Object, w.scopeField...)
+	if err != nil {
+		return "", fmt.Errorf("failed to read scope field: %w", err)
+	}
+	return value, nil
+}
+
+// scopeNameKey returns the name required by WithNameEqualsScope, which is
+// the most specific value defining the object's scope: the value of the
+// scope field if set, or else the namespace-like part of the scope.
+func (w *Webhook) scopeNameKey(obj *unstructured.Unstructured) (string, error) {
+	if len(w.scopeField) > 0 {
+		return w.scopeFieldOf(obj)
+	}
+	return w.scopeNamespaceOf(obj)
+}
+
 func generateValidatePath(gvk schema.GroupVersionKind) string {
 	return "/highlander-" + strings.ReplaceAll(gvk.Group, ".", "-") + "-" +
 		gvk.Version + "-" + strings.ToLower(gvk.Kind)
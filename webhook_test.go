@@ -0,0 +1,728 @@
+package highlander
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	admissionv1 "k8s.io/api/admission/v1"
+	coordinationv1 "k8s.io/api/coordination/v1"
+	corev1 "k8s.io/api/core/v1"
+	extensionsv1beta1 "k8s.io/api/extensions/v1beta1"
+	networkingv1 "k8s.io/api/networking/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/rest"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/webhook"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+)
+
+var testScheme = func() *runtime.Scheme {
+	scheme := runtime.NewScheme()
+	if err := clientgoscheme.AddToScheme(scheme); err != nil {
+		panic(err)
+	}
+	return scheme
+}()
+
+var configMapGVK = corev1.SchemeGroupVersion.WithKind("ConfigMap")
+
+func newTestMapper() meta.RESTMapper {
+	mapper := meta.NewDefaultRESTMapper(nil)
+	for _, kind := range []string{"ConfigMap", "Secret", "Pod"} {
+		mapper.Add(corev1.SchemeGroupVersion.WithKind(kind), meta.RESTScopeNamespace)
+	}
+	for _, kind := range []string{"Namespace", "PersistentVolume"} {
+		mapper.Add(corev1.SchemeGroupVersion.WithKind(kind), meta.RESTScopeRoot)
+	}
+	mapper.Add(coordinationv1.SchemeGroupVersion.WithKind("Lease"), meta.RESTScopeNamespace)
+	mapper.Add(networkingv1.SchemeGroupVersion.WithKind("Ingress"), meta.RESTScopeNamespace)
+	mapper.Add(extensionsv1beta1.SchemeGroupVersion.WithKind("Ingress"), meta.RESTScopeNamespace)
+	return mapper
+}
+
+// testClient is a fake client with a RESTMapper, which the fake client does
+// not provide.
+type testClient struct {
+	client.Client
+	mapper meta.RESTMapper
+}
+
+func (c testClient) RESTMapper() meta.RESTMapper {
+	return c.mapper
+}
+
+func newTestClient(objs ...client.Object) client.Client {
+	return testClient{
+		Client: fake.NewClientBuilder().
+			WithScheme(testScheme).
+			WithObjects(objs...).
+			Build(),
+		mapper: newTestMapper(),
+	}
+}
+
+// newTestWebhook returns a webhook for ConfigMaps, set up with a fake client
+// containing the given objects.
+func newTestWebhook(t *testing.T, objs []client.Object, opts ...Option) *Webhook {
+	t.Helper()
+	return newTestWebhookFor(t, &corev1.ConfigMap{}, newTestClient(objs...), opts...)
+}
+
+func newTestWebhookFor(t *testing.T, apiType client.Object, c client.Client, opts ...Option) *Webhook {
+	t.Helper()
+	w := NewFor(apiType, opts...)
+	if err := w.SetupWithServer(&webhook.Server{}, testScheme, c); err != nil {
+		t.Fatal(err)
+	}
+	return w
+}
+
+func configMap(namespace, name string) *corev1.ConfigMap {
+	return &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace: namespace,
+			Name:      name,
+		},
+	}
+}
+
+func toUnstructured(t *testing.T, obj client.Object) *unstructured.Unstructured {
+	t.Helper()
+	gvk, err := gvkOf(obj)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := runtime.DefaultUnstructuredConverter.ToUnstructured(obj)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u := &unstructured.Unstructured{Object: data}
+	u.SetGroupVersionKind(gvk)
+	return u
+}
+
+func gvkOf(obj client.Object) (schema.GroupVersionKind, error) {
+	gvks, _, err := testScheme.ObjectKinds(obj)
+	if err != nil {
+		return schema.GroupVersionKind{}, err
+	}
+	return gvks[0], nil
+}
+
+func rawObject(t *testing.T, obj client.Object) runtime.RawExtension {
+	t.Helper()
+	data, err := json.Marshal(toUnstructured(t, obj))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return runtime.RawExtension{Raw: data}
+}
+
+func createRequest(t *testing.T, obj client.Object) admission.Request {
+	t.Helper()
+	gvk, err := gvkOf(obj)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return admission.Request{
+		AdmissionRequest: admissionv1.AdmissionRequest{
+			UID:       "test",
+			Operation: admissionv1.Create,
+			Kind: metav1.GroupVersionKind{
+				Group:   gvk.Group,
+				Version: gvk.Version,
+				Kind:    gvk.Kind,
+			},
+			Namespace: obj.GetNamespace(),
+			Name:      obj.GetName(),
+			Object:    rawObject(t, obj),
+		},
+	}
+}
+
+func updateRequest(t *testing.T, oldObj, obj client.Object) admission.Request {
+	t.Helper()
+	req := createRequest(t, obj)
+	req.Operation = admissionv1.Update
+	req.OldObject = rawObject(t, oldObj)
+	return req
+}
+
+// errorClient is a client whose lists fail with the given error.
+type errorClient struct {
+	client.Client
+	err error
+}
+
+func (c errorClient) List(ctx context.Context, list client.ObjectList, opts ...client.ListOption) error {
+	return c.err
+}
+
+func expectAllowed(t *testing.T, resp admission.Response) {
+	t.Helper()
+	if !resp.Allowed {
+		t.Fatalf("expected the request to be allowed, got %+v", resp.Result)
+	}
+}
+
+func expectDenied(t *testing.T, resp admission.Response) {
+	t.Helper()
+	if resp.Allowed {
+		t.Fatalf("expected the request to be denied, got warnings %v", resp.Warnings)
+	}
+	if resp.Result == nil || resp.Result.Code != http.StatusForbidden {
+		t.Fatalf("expected a 403 denial, got %+v", resp.Result)
+	}
+}
+
+func expectErrored(t *testing.T, resp admission.Response, code int32) {
+	t.Helper()
+	if resp.Allowed {
+		t.Fatal("expected the request to be rejected with an error")
+	}
+	if resp.Result == nil || resp.Result.Code != code {
+		t.Fatalf("expected a %d error, got %+v", code, resp.Result)
+	}
+}
+
+func TestHandleAlwaysReturnsADecision(t *testing.T) {
+	existing := configMap("default", "existing")
+	cases := []struct {
+		name    string
+		w       func(t *testing.T) *Webhook
+		req     func(t *testing.T) admission.Request
+		allowed bool
+		code    int32
+	}{
+		{
+			name: "wrong kind",
+			w:    func(t *testing.T) *Webhook { return newTestWebhook(t, nil) },
+			req: func(t *testing.T) admission.Request {
+				return createRequest(t, &corev1.Secret{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "s"}})
+			},
+			allowed: true,
+			code:    http.StatusOK,
+		},
+		{
+			name: "wrong operation",
+			w:    func(t *testing.T) *Webhook { return newTestWebhook(t, []client.Object{existing}) },
+			req: func(t *testing.T) admission.Request {
+				req := createRequest(t, configMap("default", "new"))
+				req.Operation = admissionv1.Delete
+				return req
+			},
+			allowed: true,
+			code:    http.StatusOK,
+		},
+		{
+			name: "undecodable object",
+			w:    func(t *testing.T) *Webhook { return newTestWebhook(t, nil) },
+			req: func(t *testing.T) admission.Request {
+				req := createRequest(t, configMap("default", "new"))
+				req.Object.Raw = []byte("{")
+				return req
+			},
+			code: http.StatusBadRequest,
+		},
+		{
+			name: "list error",
+			w: func(t *testing.T) *Webhook {
+				return newTestWebhookFor(t, &corev1.ConfigMap{},
+					errorClient{Client: newTestClient(), err: errors.New("unavailable")})
+			},
+			req: func(t *testing.T) admission.Request {
+				return createRequest(t, configMap("default", "new"))
+			},
+			code: http.StatusBadRequest,
+		},
+		{
+			name: "conflict",
+			w:    func(t *testing.T) *Webhook { return newTestWebhook(t, []client.Object{existing}) },
+			req: func(t *testing.T) admission.Request {
+				return createRequest(t, configMap("default", "new"))
+			},
+			code: http.StatusForbidden,
+		},
+		{
+			name: "no conflict",
+			w:    func(t *testing.T) *Webhook { return newTestWebhook(t, []client.Object{existing}) },
+			req: func(t *testing.T) admission.Request {
+				return createRequest(t, configMap("other", "new"))
+			},
+			allowed: true,
+			code:    http.StatusOK,
+		},
+		{
+			name: "update",
+			w:    func(t *testing.T) *Webhook { return newTestWebhook(t, []client.Object{existing}) },
+			req: func(t *testing.T) admission.Request {
+				return updateRequest(t, existing, existing)
+			},
+			allowed: true,
+			code:    http.StatusOK,
+		},
+		{
+			name: "panic",
+			w: func(t *testing.T) *Webhook {
+				return newTestWebhook(t, nil, WithShardFunc(func(*unstructured.Unstructured) (string, error) {
+					panic("shard")
+				}))
+			},
+			req: func(t *testing.T) admission.Request {
+				return createRequest(t, configMap("default", "new"))
+			},
+			code: http.StatusInternalServerError,
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			resp := tc.w(t).Handle(context.Background(), tc.req(t))
+			if resp.Result == nil {
+				t.Fatal("response has no result")
+			}
+			if resp.Allowed != tc.allowed {
+				t.Errorf("expected allowed to be %v, got %v: %+v", tc.allowed, resp.Allowed, resp.Result)
+			}
+			if resp.Result.Code != tc.code {
+				t.Errorf("expected code %d, got %d: %+v", tc.code, resp.Result.Code, resp.Result)
+			}
+			if !resp.Allowed && resp.Result.Message == "" && resp.Result.Reason == "" {
+				t.Error("rejected response has no message or reason")
+			}
+		})
+	}
+}
+
+func zoneConfigMap(namespace, name, zone string) *corev1.ConfigMap {
+	cm := configMap(namespace, name)
+	cm.Data = map[string]string{"zone": zone}
+	return cm
+}
+
+func TestUpdateIntoOccupiedScope(t *testing.T) {
+	a := zoneConfigMap("default", "a", "east")
+	b := zoneConfigMap("default", "b", "west")
+	w := newTestWebhook(t, []client.Object{a, b}, WithScopeField("data", "zone"))
+
+	// Moving into a scope which already has an instance is a conflict
+	expectDenied(t, w.Handle(context.Background(),
+		updateRequest(t, b, zoneConfigMap("default", "b", "east"))))
+	// Moving into an empty scope is allowed
+	expectAllowed(t, w.Handle(context.Background(),
+		updateRequest(t, b, zoneConfigMap("default", "b", "north"))))
+	// Updates which stay in the same scope are not checked
+	updated := zoneConfigMap("default", "b", "west")
+	updated.Labels = map[string]string{"updated": "true"}
+	expectAllowed(t, w.Handle(context.Background(), updateRequest(t, b, updated)))
+}
+
+func TestUpdateWithUnknownScope(t *testing.T) {
+	w := newTestWebhook(t, []client.Object{configMap("default", "existing")},
+		WithShardFunc(func(obj *unstructured.Unstructured) (string, error) {
+			if obj.GetLabels()["shard"] == "" {
+				return "", errors.New("no shard label")
+			}
+			return obj.GetLabels()["shard"], nil
+		}))
+	sharded := func(name, shard string) *corev1.ConfigMap {
+		cm := configMap("default", name)
+		if shard != "" {
+			cm.Labels = map[string]string{"shard": shard}
+		}
+		return cm
+	}
+
+	// The scope of the existing object cannot be computed
+	resp := w.Handle(context.Background(), updateRequest(t, sharded("b", ""), sharded("b", "1")))
+	expectAllowed(t, resp)
+	if len(resp.Warnings) != 1 ||
+		resp.Warnings[0] != "allowed without checking the scope of this object: failed to compute shard: no shard label" {
+		t.Errorf("unexpected warnings %v", resp.Warnings)
+	}
+	expectAllowed(t, w.Handle(context.Background(), updateRequest(t, sharded("b", ""), sharded("b", ""))))
+	// An update which makes the scope unknown is rejected
+	resp = w.Handle(context.Background(), updateRequest(t, sharded("b", "1"), sharded("b", "")))
+	expectErrored(t, resp, http.StatusBadRequest)
+}
+
+func TestUpdateOfTerminatingObject(t *testing.T) {
+	a := zoneConfigMap("default", "a", "east")
+	b := zoneConfigMap("default", "b", "west")
+	w := newTestWebhook(t, []client.Object{a, b},
+		WithScopeField("data", "zone"),
+		WithImmutableIdentity(true))
+
+	updated := zoneConfigMap("default", "b", "east")
+	now := metav1.Now()
+	updated.DeletionTimestamp = &now
+	expectAllowed(t, w.Handle(context.Background(), updateRequest(t, b, updated)))
+}
+
+func TestValidateCreate(t *testing.T) {
+	w := newTestWebhook(t, []client.Object{configMap("default", "existing")})
+
+	_, err := w.ValidateCreate(context.Background(), toUnstructured(t, configMap("default", "new")))
+	var conflict *ConflictError
+	if !errors.As(err, &conflict) {
+		t.Fatalf("expected a *ConflictError, got %v", err)
+	}
+	if !errors.Is(err, ErrThereCanBeOnlyOne) {
+		t.Errorf("expected the error to wrap ErrThereCanBeOnlyOne, got %v", err)
+	}
+	if len(conflict.Conflicts) != 1 || conflict.Conflicts[0] != "existing" {
+		t.Errorf("expected the conflict to name the existing instance, got %v", conflict.Conflicts)
+	}
+
+	if _, err := w.ValidateCreate(context.Background(), toUnstructured(t, configMap("other", "new"))); err != nil {
+		t.Errorf("expected no conflict in another namespace, got %v", err)
+	}
+}
+
+func TestSetupWithServer(t *testing.T) {
+	server := &webhook.Server{}
+	w := NewFor(&corev1.ConfigMap{}, WithAdmittedAtAnnotation(true))
+	if err := w.SetupWithServer(server, testScheme, newTestClient(configMap("default", "existing"))); err != nil {
+		t.Fatal(err)
+	}
+	resp := serveAdmission(t, server, generateValidatePath(configMapGVK),
+		createRequest(t, configMap("default", "new")))
+	if resp.Allowed {
+		t.Error("expected the validating webhook to deny the conflicting create")
+	}
+	resp = serveAdmission(t, server, generateMutatePath(configMapGVK),
+		createRequest(t, configMap("default", "new")))
+	if !resp.Allowed || len(resp.Patch) == 0 {
+		t.Error("expected the mutating webhook to be registered and patch the object")
+	}
+}
+
+func TestSetupWithServerErrors(t *testing.T) {
+	cases := map[string]struct {
+		apiType client.Object
+		opts    []Option
+	}{
+		"impersonation without a manager": {
+			apiType: &corev1.ConfigMap{},
+			opts:    []Option{WithImpersonation(true)},
+		},
+		"invalid name pattern": {
+			apiType: &corev1.ConfigMap{},
+			opts:    []Option{WithNamePattern("(")},
+		},
+		"unmapped kind": {
+			apiType: &corev1.Service{},
+		},
+	}
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			w := NewFor(tc.apiType, tc.opts...)
+			if err := w.SetupWithServer(&webhook.Server{}, testScheme, newTestClient()); err == nil {
+				t.Error("expected setup to fail")
+			}
+		})
+	}
+}
+
+// blockingClient is a client whose lists block until release is closed.
+type blockingClient struct {
+	client.Client
+	listing chan struct{}
+	release chan struct{}
+}
+
+func (c blockingClient) List(ctx context.Context, list client.ObjectList, opts ...client.ListOption) error {
+	c.listing <- struct{}{}
+	<-c.release
+	return c.Client.List(ctx, list, opts...)
+}
+
+func TestMaxConcurrent(t *testing.T) {
+	c := blockingClient{
+		Client:  newTestClient(),
+		listing: make(chan struct{}, 2),
+		release: make(chan struct{}),
+	}
+	w := newTestWebhookFor(t, &corev1.ConfigMap{}, c, WithMaxConcurrent(1))
+
+	first := make(chan admission.Response)
+	go func() {
+		first <- w.Handle(context.Background(), createRequest(t, configMap("default", "first")))
+	}()
+	<-c.listing
+
+	// The second validation waits for the first list, until its deadline
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	resp := w.Handle(ctx, createRequest(t, configMap("other", "second")))
+	if resp.Allowed {
+		t.Error("expected the second validation to fail while the first is listing")
+	}
+	select {
+	case <-c.listing:
+		t.Error("the second validation listed while the first was in flight")
+	default:
+	}
+
+	close(c.release)
+	expectAllowed(t, <-first)
+	expectAllowed(t, w.Handle(context.Background(), createRequest(t, configMap("other", "third"))))
+}
+
+func TestMaxConcurrentSerializes(t *testing.T) {
+	c := blockingClient{
+		Client:  newTestClient(),
+		listing: make(chan struct{}, 2),
+		release: make(chan struct{}),
+	}
+	w := newTestWebhookFor(t, &corev1.ConfigMap{}, c, WithMaxConcurrent(1))
+
+	first := make(chan admission.Response, 1)
+	go func() {
+		first <- w.Handle(context.Background(), createRequest(t, configMap("default", "first")))
+	}()
+	<-c.listing
+	second := make(chan admission.Response, 1)
+	go func() {
+		second <- w.Handle(context.Background(), createRequest(t, configMap("other", "second")))
+	}()
+
+	// The second validation does not list while the first is listing
+	select {
+	case <-c.listing:
+		t.Fatal("the second validation listed while the first was in flight")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	// Once the first list is released, the second one starts
+	c.release <- struct{}{}
+	expectAllowed(t, <-first)
+	select {
+	case <-c.listing:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the second validation did not list after the first finished")
+	}
+	select {
+	case <-second:
+		t.Fatal("the second validation finished before its list was released")
+	default:
+	}
+	c.release <- struct{}{}
+	expectAllowed(t, <-second)
+}
+
+func terminating(obj client.Object) client.Object {
+	now := metav1.Now()
+	obj.SetDeletionTimestamp(&now)
+	obj.SetFinalizers([]string{"example.com/finalizer"})
+	return obj
+}
+
+func TestTerminatingInstanceWarning(t *testing.T) {
+	w := newTestWebhook(t, []client.Object{terminating(configMap("default", "old"))})
+	resp := w.Handle(context.Background(), createRequest(t, configMap("default", "new")))
+	expectAllowed(t, resp)
+	if len(resp.Warnings) != 1 || resp.Warnings[0] != `allowed because existing instance "old" is terminating` {
+		t.Errorf("unexpected warnings %v", resp.Warnings)
+	}
+
+	resp = w.Handle(context.Background(), createRequest(t, configMap("other", "new")))
+	expectAllowed(t, resp)
+	if len(resp.Warnings) != 0 {
+		t.Errorf("expected no warnings without a terminating instance, got %v", resp.Warnings)
+	}
+}
+
+func TestImmutableIdentity(t *testing.T) {
+	b := zoneConfigMap("default", "b", "west")
+	w := newTestWebhook(t, []client.Object{b},
+		WithScopeField("data", "zone"),
+		WithImmutableIdentity(true))
+
+	// Changing the scope is denied even if the new scope is empty
+	resp := w.Handle(context.Background(), updateRequest(t, b, zoneConfigMap("default", "b", "north")))
+	expectDenied(t, resp)
+	if resp.Result.Reason != metav1.StatusReason(ErrScopeImmutable.Error()) {
+		t.Errorf("unexpected reason %q", resp.Result.Reason)
+	}
+
+	updated := zoneConfigMap("default", "b", "west")
+	updated.Labels = map[string]string{"updated": "true"}
+	expectAllowed(t, w.Handle(context.Background(), updateRequest(t, b, updated)))
+}
+
+func TestImpersonation(t *testing.T) {
+	// The API server only shows the existing instance to alice
+	users := make(chan string, 2)
+	apiServer := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		user := r.Header.Get("Impersonate-User")
+		users <- user
+		list := corev1.ConfigMapList{
+			TypeMeta: metav1.TypeMeta{APIVersion: "v1", Kind: "ConfigMapList"},
+		}
+		if user == "alice" {
+			list.Items = append(list.Items, *configMap("default", "existing"))
+		}
+		rw.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(rw).Encode(list); err != nil {
+			t.Error(err)
+		}
+	}))
+	defer apiServer.Close()
+
+	w := NewFor(&corev1.ConfigMap{}, WithImpersonation(true))
+	w.restConfig = &rest.Config{Host: apiServer.URL}
+	if err := w.SetupWithServer(&webhook.Server{}, testScheme, newTestClient(configMap("default", "existing"))); err != nil {
+		t.Fatal(err)
+	}
+
+	req := createRequest(t, configMap("default", "new"))
+	req.UserInfo.Username = "alice"
+	expectDenied(t, w.Handle(context.Background(), req))
+	if user := <-users; user != "alice" {
+		t.Errorf("expected the list to impersonate alice, got %q", user)
+	}
+
+	req.UserInfo.Username = "bob"
+	expectAllowed(t, w.Handle(context.Background(), req))
+	if user := <-users; user != "bob" {
+		t.Errorf("expected the list to impersonate bob, got %q", user)
+	}
+}
+
+func TestDrain(t *testing.T) {
+	existing := configMap("default", "existing")
+	w := newTestWebhook(t, []client.Object{existing})
+	if w.Drained() {
+		t.Fatal("webhook is drained by default")
+	}
+
+	w.SetDrain(true)
+	resp := w.Handle(context.Background(), createRequest(t, configMap("other", "new")))
+	expectDenied(t, resp)
+	if resp.Result.Reason != metav1.StatusReason(ErrDrained.Error()) {
+		t.Errorf("unexpected reason %q", resp.Result.Reason)
+	}
+	// Updates of existing instances are not affected
+	updated := configMap("default", "existing")
+	updated.Labels = map[string]string{"updated": "true"}
+	expectAllowed(t, w.Handle(context.Background(), updateRequest(t, existing, updated)))
+
+	w.SetDrain(false)
+	expectAllowed(t, w.Handle(context.Background(), createRequest(t, configMap("other", "new"))))
+}
+
+func TestRestoredObjectIsNotAConflict(t *testing.T) {
+	existing := configMap("default", "existing")
+	existing.UID = "restored-uid"
+	w := newTestWebhook(t, []client.Object{existing})
+
+	// A restore of the existing object carries its UID
+	restored := configMap("default", "restored")
+	restored.UID = "restored-uid"
+	restored.ResourceVersion = "42"
+	expectAllowed(t, w.Handle(context.Background(), createRequest(t, restored)))
+
+	// So does one with the same name, which the API server rejects as
+	// AlreadyExists
+	sameName := configMap("default", "existing")
+	sameName.ResourceVersion = "42"
+	expectAllowed(t, w.Handle(context.Background(), createRequest(t, sameName)))
+
+	expectDenied(t, w.Handle(context.Background(), createRequest(t, configMap("default", "new"))))
+}
+
+func TestComputeListOptions(t *testing.T) {
+	cases := []struct {
+		name     string
+		w        func(t *testing.T) *Webhook
+		incoming client.Object
+		expected client.ListOptions
+	}{
+		{
+			name:     "default",
+			w:        func(t *testing.T) *Webhook { return newTestWebhook(t, nil) },
+			incoming: configMap("default", "new"),
+			expected: client.ListOptions{Namespace: "default"},
+		},
+		{
+			name: "page size",
+			w: func(t *testing.T) *Webhook {
+				return newTestWebhook(t, nil, WithListPageSize(50))
+			},
+			incoming: configMap("default", "new"),
+			expected: client.ListOptions{Namespace: "default", Limit: 50},
+		},
+		{
+			name: "cluster-wide scope",
+			w: func(t *testing.T) *Webhook {
+				return newTestWebhook(t, nil, WithClusterWideScope(true), WithListPageSize(50))
+			},
+			incoming: configMap("default", "new"),
+			expected: client.ListOptions{Limit: 50},
+		},
+		{
+			name: "scope namespace field",
+			w: func(t *testing.T) *Webhook {
+				return newTestWebhook(t, nil, WithScopeNamespaceField("data.target"))
+			},
+			incoming: targetConfigMap("central", "new", "team-a"),
+			expected: client.ListOptions{},
+		},
+		{
+			// Label values and scope fields are applied to the listed objects
+			name: "unique label and scope field",
+			w: func(t *testing.T) *Webhook {
+				return newTestWebhook(t, nil,
+					WithUniqueLabelValue("role", "leader"),
+					WithScopeField("data", "zone"))
+			},
+			incoming: labeledConfigMap("default", "new", map[string]string{"role": "leader"}),
+			expected: client.ListOptions{Namespace: "default"},
+		},
+		{
+			name: "cluster-scoped kind",
+			w: func(t *testing.T) *Webhook {
+				return newTestWebhookFor(t, &corev1.PersistentVolume{}, newTestClient(),
+					WithScopeAnnotation(NamespaceAnnotation))
+			},
+			incoming: persistentVolume("new", "default"),
+			expected: client.ListOptions{},
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			opts, err := c.w(t).ComputeListOptions(toUnstructured(t, c.incoming))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(*opts, c.expected) {
+				t.Errorf("expected %+v, got %+v", c.expected, *opts)
+			}
+		})
+	}
+
+	w := newTestWebhook(t, nil)
+	// Objects without a kind are assumed to be of the webhook's kind
+	u := toUnstructured(t, configMap("default", "new"))
+	u.SetGroupVersionKind(schema.GroupVersionKind{})
+	if opts, err := w.ComputeListOptions(u); err != nil || opts.Namespace != "default" {
+		t.Errorf("unexpected options %+v, %v", opts, err)
+	}
+	if _, err := w.ComputeListOptions(toUnstructured(t, &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "new"},
+	})); err == nil || err.Error() != "Secret is not checked by this webhook" {
+		t.Errorf("expected an error for another kind, got %v", err)
+	}
+}
@@ -0,0 +1,53 @@
+package highlander
+
+import (
+	"time"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+// KeepPolicy determines which instance is kept when several instances exist
+// in the same scope.
+type KeepPolicy int
+
+const (
+	// KeepOldest keeps the instance which was created first.
+	KeepOldest KeepPolicy = iota
+	// KeepNewest keeps the instance which was created last.
+	KeepNewest
+)
+
+// PickWinner returns the instance which should be kept according to the
+// given policy, or nil if there are no items. Instances are ordered by their
+// creation timestamp, then by their AdmittedAtAnnotation if both instances
+// have one, and finally by UID, so the result does not depend on the order
+// of the items.
+func PickWinner(items []unstructured.Unstructured, policy KeepPolicy) *unstructured.Unstructured {
+	var winner *unstructured.Unstructured
+	for i := range items {
+		item := &items[i]
+		if winner == nil {
+			winner = item
+			continue
+		}
+		older := createdBefore(item, winner)
+		if (policy == KeepOldest && older) || (policy == KeepNewest && !older) {
+			winner = item
+		}
+	}
+	return winner
+}
+
+// createdBefore returns whether a was created before b.
+func createdBefore(a, b *unstructured.Unstructured) bool {
+	ta, tb := a.GetCreationTimestamp(), b.GetCreationTimestamp()
+	if !ta.Equal(&tb) {
+		return ta.Before(&tb)
+	}
+	aa, aErr := time.Parse(time.RFC3339Nano, a.GetAnnotations()[AdmittedAtAnnotation])
+	ab, bErr := time.Parse(time.RFC3339Nano, b.GetAnnotations()[AdmittedAtAnnotation])
+	if aErr == nil && bErr == nil && !aa.Equal(ab) {
+		return aa.Before(ab)
+	}
+	return a.GetUID() < b.GetUID()
+}
@@ -0,0 +1,79 @@
+package highlander
+
+import (
+	"testing"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+func instance(name string, created time.Time, admittedAt string, uid types.UID) unstructured.Unstructured {
+	u := unstructured.Unstructured{}
+	u.SetName(name)
+	u.SetCreationTimestamp(metav1.NewTime(created))
+	u.SetUID(uid)
+	if admittedAt != "" {
+		u.SetAnnotations(map[string]string{AdmittedAtAnnotation: admittedAt})
+	}
+	return u
+}
+
+func TestPickWinner(t *testing.T) {
+	t0 := time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+	t1 := t0.Add(time.Second)
+
+	cases := map[string]struct {
+		items  []unstructured.Unstructured
+		oldest string
+		newest string
+	}{
+		"creation timestamp": {
+			items: []unstructured.Unstructured{
+				instance("b", t1, "", "1"),
+				instance("a", t0, "", "2"),
+			},
+			oldest: "a",
+			newest: "b",
+		},
+		"admitted-at breaks creation timestamp ties": {
+			items: []unstructured.Unstructured{
+				instance("a", t0, t0.Add(2*time.Millisecond).Format(time.RFC3339Nano), "1"),
+				instance("b", t0, t0.Add(time.Millisecond).Format(time.RFC3339Nano), "2"),
+			},
+			oldest: "b",
+			newest: "a",
+		},
+		"uid breaks remaining ties": {
+			items: []unstructured.Unstructured{
+				instance("a", t0, "", "2"),
+				instance("b", t0, "", "1"),
+				instance("c", t0, "invalid", "3"),
+			},
+			oldest: "b",
+			newest: "c",
+		},
+	}
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			reversed := make([]unstructured.Unstructured, len(tc.items))
+			for i := range tc.items {
+				reversed[len(tc.items)-1-i] = tc.items[i]
+			}
+			// The result does not depend on the order of the items
+			for _, items := range [][]unstructured.Unstructured{tc.items, reversed} {
+				if winner := PickWinner(items, KeepOldest); winner.GetName() != tc.oldest {
+					t.Errorf("expected %q to be the oldest, got %q", tc.oldest, winner.GetName())
+				}
+				if winner := PickWinner(items, KeepNewest); winner.GetName() != tc.newest {
+					t.Errorf("expected %q to be the newest, got %q", tc.newest, winner.GetName())
+				}
+			}
+		})
+	}
+
+	if PickWinner(nil, KeepOldest) != nil {
+		t.Error("expected no winner without items")
+	}
+}